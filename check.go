@@ -0,0 +1,540 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// A value on the stack of the Checker. Only the kind of the value is known
+// statically, and not even that if the value came from something the Checker
+// cannot see through.
+type CheckValue struct {
+	Kind  TokenKind
+	Known bool
+	Loc   Loc
+	// The literal the value came from. Allows to understand statically the
+	// names passed to `define` and `let`, the paths passed to `include` and
+	// the bodies passed to `if`, `each` etc.
+	Literal *Node
+	// The elements of a list if they are known
+	Elems []CheckValue
+}
+
+type CheckWord struct {
+	Loc  Loc
+	Body []Node
+	// The word is being expanded right now, so calling it again is a recursion
+	Expanding bool
+}
+
+type CheckFrame struct {
+	Loc  Loc
+	Name string
+}
+
+// Simulates the stack effects of the MARKUT files without evaluating them
+type Checker struct {
+	stack []CheckValue
+	words map[string]*CheckWord
+	vars  map[string]CheckValue
+	// The names of words and variables or the paths of the included files
+	// were computed at runtime, so unknown symbols are not necessarily errors
+	dynamic bool
+	// The Checker lost track of the stack and cannot reliably check the rest
+	// of the code
+	lost bool
+	// The files that are being checked right now, the innermost goes last
+	including []IncludeFrame
+	// Absolute paths of all the files checked so far
+	included    map[string]bool
+	includePath []string
+	// Words that are being expanded, the innermost goes last
+	frames   []CheckFrame
+	reported map[string]bool
+	Errors   int
+}
+
+func NewChecker() Checker {
+	return Checker{
+		words:    map[string]*CheckWord{},
+		vars:     map[string]CheckValue{},
+		included: map[string]bool{},
+		reported: map[string]bool{},
+	}
+}
+
+// The bodies of the words are checked on every call, so the same error may
+// show up many times. Only the first one is reported.
+func (checker *Checker) report(loc Loc, message string, notes ...Diag) {
+	key := fmt.Sprintf("%s: %s", loc, message)
+	for _, note := range notes {
+		key += fmt.Sprintf("\n%s: %s", note.Loc, note.Message)
+	}
+	if checker.reported[key] {
+		return
+	}
+	checker.reported[key] = true
+	checker.Errors += 1
+	report := Diags.Error(loc, "%s", message)
+	for _, note := range notes {
+		report.Note(note.Loc, "%s", note.Message)
+	}
+	checker.noteFrames(report)
+}
+
+func (checker *Checker) noteFrames(report Report) {
+	for i := len(checker.frames) - 1; i >= 0; i -= 1 {
+		report.Note(checker.frames[i].Loc, "in the expansion of word %s", checker.frames[i].Name)
+	}
+}
+
+func checkNote(loc Loc, format string, args ...any) Diag {
+	return Diag{Severity: SeverityNote, Loc: loc, Message: fmt.Sprintf(format, args...)}
+}
+
+func (checker *Checker) lose(loc Loc, reason string) {
+	if checker.lost {
+		return
+	}
+	checker.lost = true
+	report := Diags.Warning("unchecked", loc, "%s, the code after this point is not checked", reason)
+	checker.noteFrames(report)
+	if report.Fatal {
+		checker.Errors += 1
+	}
+}
+
+func (checker *Checker) push(value CheckValue) {
+	checker.stack = append(checker.stack, value)
+}
+
+func unknownValue(loc Loc) CheckValue {
+	return CheckValue{Loc: loc}
+}
+
+func knownValue(kind TokenKind, loc Loc) CheckValue {
+	return CheckValue{Kind: kind, Known: true, Loc: loc}
+}
+
+func checkValueName(value CheckValue) string {
+	if !value.Known {
+		return "unknown"
+	}
+	return TokenKindName[value.Kind]
+}
+
+func sameStackShape(a []CheckValue, b []CheckValue) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Known && b[i].Known && a[i].Kind != b[i].Kind {
+			return false
+		}
+	}
+	return true
+}
+
+func stackShapeToString(stack []CheckValue) string {
+	names := []string{}
+	for _, value := range stack {
+		names = append(names, "<"+checkValueName(value)+">")
+	}
+	if len(names) == 0 {
+		return "nothing"
+	}
+	return strings.Join(names, " ")
+}
+
+// Pops the arguments of the signature reporting all the mismatches. Returns
+// the popped arguments, args[0] is the top of the stack, and the kinds bound
+// to the type variables of the signature.
+func (checker *Checker) popArgs(loc Loc, command string, signature Signature) (args []CheckValue, vars map[string]TokenKind) {
+	n := len(checker.stack)
+	if n < len(signature.Ins) {
+		checker.report(loc, fmt.Sprintf("type check failed for %s", command), checkNote(loc, "Expected %d arguments but got %d", len(signature.Ins), n))
+		// Pretending that the missing arguments were provided to keep going
+		for i := 0; i < len(signature.Ins)-n; i += 1 {
+			checker.stack = append([]CheckValue{unknownValue(loc)}, checker.stack...)
+		}
+	}
+
+	vars = map[string]TokenKind{}
+	for i := len(signature.Ins) - 1; i >= 0; i -= 1 {
+		param := signature.Ins[i]
+		n := len(checker.stack)
+		arg := checker.stack[n-1]
+		checker.stack = checker.stack[:n-1]
+		args = append(args, arg)
+		if !arg.Known {
+			continue
+		}
+		if len(param.Kinds) > 0 && !slices.Contains(param.Kinds, arg.Kind) {
+			checker.report(loc, fmt.Sprintf("type check failed for %s", command), checkNote(arg.Loc, "Expected %s but got %s", kindNamesToString(param.Kinds), TokenKindName[arg.Kind]))
+			continue
+		}
+		if param.Var != "" {
+			if kind, ok := vars[param.Var]; ok && kind != arg.Kind {
+				checker.report(loc, fmt.Sprintf("type check failed for %s", command), checkNote(arg.Loc, "Expected %s but got %s", TokenKindName[kind], TokenKindName[arg.Kind]))
+				continue
+			}
+			vars[param.Var] = arg.Kind
+		}
+	}
+	return
+}
+
+func (checker *Checker) pushOuts(loc Loc, signature Signature, vars map[string]TokenKind) {
+	for _, param := range signature.Outs {
+		value := unknownValue(loc)
+		if kind, ok := vars[param.Var]; ok && param.Var != "" {
+			value = knownValue(kind, loc)
+		} else if len(param.Kinds) == 1 {
+			value = knownValue(param.Kinds[0], loc)
+		}
+		checker.push(value)
+	}
+}
+
+func arithmeticResultKind(op TokenKind, a TokenKind, b TokenKind) TokenKind {
+	switch op {
+	case TokenAsterisk:
+		if a == TokenNumber && b == TokenNumber {
+			return TokenNumber
+		}
+		return TokenTimestamp
+	case TokenSlash:
+		if a == TokenTimestamp && b == TokenTimestamp {
+			return TokenNumber
+		}
+	}
+	return a
+}
+
+func (checker *Checker) checkArithmetic(token Token) {
+	name := ArithmeticNames[token.Kind]
+	n := len(checker.stack)
+	if n < 2 {
+		checker.report(token.Loc, fmt.Sprintf("type check failed for %s", name), checkNote(token.Loc, "Expected %d arguments but got %d", 2, n))
+		checker.stack = nil
+		checker.push(unknownValue(token.Loc))
+		return
+	}
+	a := checker.stack[n-2]
+	b := checker.stack[n-1]
+	checker.stack = checker.stack[:n-2]
+
+	results := map[TokenKind]bool{}
+	expected := []string{}
+	for _, overload := range ArithmeticOverloads[token.Kind] {
+		expected = append(expected, kindsToString(overload))
+		if b.Known && overload[0] != b.Kind || a.Known && overload[1] != a.Kind {
+			continue
+		}
+		results[arithmeticResultKind(token.Kind, overload[1], overload[0])] = true
+	}
+	if len(results) == 0 {
+		checker.report(token.Loc, fmt.Sprintf("type check failed for %s", name), checkNote(b.Loc, "Expected %s but got %s", strings.Join(expected, " or "), kindsToString([]TokenKind{b.Kind, a.Kind})))
+		checker.push(unknownValue(token.Loc))
+		return
+	}
+	if len(results) > 1 {
+		checker.push(unknownValue(token.Loc))
+		return
+	}
+	for kind := range results {
+		checker.push(knownValue(kind, token.Loc))
+	}
+}
+
+func literalString(value CheckValue) (string, bool) {
+	if value.Literal == nil || value.Literal.Kind != NodeToken || value.Literal.Token.Kind != TokenString {
+		return "", false
+	}
+	return string(value.Literal.Token.Text), true
+}
+
+func literalBlock(value CheckValue) ([]Node, bool) {
+	if value.Literal == nil || value.Literal.Kind != NodeBlock {
+		return nil, false
+	}
+	return value.Literal.Children, true
+}
+
+// Checks the body of a block called by a func like `if` or `each`. Returns
+// false if the body is not known statically.
+func (checker *Checker) checkBlockArg(token Token, command string, block CheckValue) bool {
+	body, ok := literalBlock(block)
+	if !ok {
+		if block.Known && block.Kind == TokenBlock {
+			checker.lose(token.Loc, fmt.Sprintf("the body of %s is not known statically", command))
+		}
+		return false
+	}
+	checker.checkNodes(body)
+	return true
+}
+
+func (checker *Checker) checkFunc(token Token, command string, f Func) {
+	args, vars := checker.popArgs(token.Loc, command, f.Signature)
+	base := slices.Clone(checker.stack)
+
+	switch command {
+	default:
+		checker.pushOuts(token.Loc, f.Signature, vars)
+	case "define":
+		name, nameOk := literalString(args[0])
+		body, bodyOk := literalBlock(args[1])
+		if !nameOk || !bodyOk {
+			checker.dynamic = true
+			return
+		}
+		checker.words[name] = &CheckWord{
+			Loc:  args[0].Loc,
+			Body: body,
+		}
+	case "let", "const":
+		name, ok := literalString(args[0])
+		if !ok {
+			checker.dynamic = true
+			return
+		}
+		checker.vars[name] = args[1]
+	case "if":
+		if !checker.checkBlockArg(token, command, args[0]) {
+			return
+		}
+		if !checker.lost && !sameStackShape(checker.stack, base) {
+			checker.report(token.Loc, "the body of if must leave the stack unchanged since it may not be evaluated", checkNote(args[0].Loc, "the stack before the body: %s", stackShapeToString(base)), checkNote(args[0].Loc, "the stack after the body: %s", stackShapeToString(checker.stack)))
+			checker.stack = base
+		}
+	case "if_else":
+		if !checker.checkBlockArg(token, command, args[1]) {
+			return
+		}
+		then := checker.stack
+		checker.stack = slices.Clone(base)
+		if !checker.checkBlockArg(token, command, args[0]) {
+			return
+		}
+		if !checker.lost && !sameStackShape(then, checker.stack) {
+			checker.report(token.Loc, "the branches of if_else leave different values on the stack", checkNote(args[1].Loc, "the then branch leaves %s", stackShapeToString(then)), checkNote(args[0].Loc, "the else branch leaves %s", stackShapeToString(checker.stack)))
+			checker.stack = then
+		}
+	case "each", "map":
+		element := unknownValue(args[1].Loc)
+		if len(args[1].Elems) > 0 {
+			element = args[1].Elems[0]
+			for _, elem := range args[1].Elems[1:] {
+				if !sameStackShape([]CheckValue{elem}, []CheckValue{element}) {
+					element = unknownValue(args[1].Loc)
+					break
+				}
+			}
+		}
+		checker.push(element)
+		if !checker.checkBlockArg(token, command, args[0]) {
+			return
+		}
+		if checker.lost {
+			return
+		}
+		if command == "each" {
+			if !sameStackShape(checker.stack, base) {
+				checker.report(token.Loc, "the body of each must consume the element and leave the rest of the stack unchanged", checkNote(args[0].Loc, "the stack before the body: %s", stackShapeToString(base)), checkNote(args[0].Loc, "the stack after the body: %s", stackShapeToString(checker.stack)))
+				checker.stack = base
+			}
+			return
+		}
+		depth := len(base)
+		if len(checker.stack) < depth || !sameStackShape(checker.stack[:depth], base[:depth]) {
+			checker.report(token.Loc, "the body of map consumes the values that were pushed before it was called")
+			checker.stack = append(base, knownValue(TokenList, token.Loc))
+			return
+		}
+		list := knownValue(TokenList, token.Loc)
+		list.Elems = slices.Clone(checker.stack[depth:])
+		checker.stack = append(checker.stack[:depth], list)
+	case "include", "include_if_exists", "include_once":
+		path, ok := literalString(args[0])
+		if !ok {
+			checker.dynamic = true
+			return
+		}
+		path = resolveIncludePath(args[0].Loc.FilePath, checker.includePath, path)
+		if command == "include_once" && checker.included[includeKey(path)] {
+			return
+		}
+		checker.checkFile(&args[0].Loc, path, command == "include_if_exists")
+	case "include_path":
+		dir, ok := literalString(args[0])
+		if !ok {
+			checker.dynamic = true
+			return
+		}
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(filepath.Dir(args[0].Loc.FilePath), dir)
+		}
+		if !slices.Contains(checker.includePath, dir) {
+			checker.includePath = append(checker.includePath, dir)
+		}
+	}
+}
+
+func (checker *Checker) checkSymbol(token Token) {
+	command := string(token.Text)
+	if f, ok := funcs[command]; ok {
+		checker.checkFunc(token, command, f)
+		return
+	}
+	if word, ok := checker.words[command]; ok {
+		if word.Expanding {
+			checker.lose(token.Loc, fmt.Sprintf("the stack effect of the recursive word %s cannot be inferred", command))
+			return
+		}
+		word.Expanding = true
+		checker.frames = append(checker.frames, CheckFrame{Loc: token.Loc, Name: command})
+		checker.checkNodes(word.Body)
+		checker.frames = checker.frames[:len(checker.frames)-1]
+		word.Expanding = false
+		return
+	}
+	if variable, ok := checker.vars[command]; ok {
+		variable.Loc = token.Loc
+		checker.push(variable)
+		return
+	}
+	if checker.dynamic {
+		checker.lose(token.Loc, fmt.Sprintf("%s may be defined by a name computed at runtime", command))
+		return
+	}
+	checker.report(token.Loc, fmt.Sprintf("Unknown command %s", command))
+}
+
+func (checker *Checker) checkNodes(nodes []Node) {
+	for i := range nodes {
+		if checker.lost {
+			return
+		}
+		node := &nodes[i]
+		token := node.Token
+		switch node.Kind {
+		case NodeComment:
+		case NodeBlock:
+			value := knownValue(TokenBlock, token.Loc)
+			value.Literal = node
+			checker.push(value)
+		case NodeList:
+			depth := len(checker.stack)
+			checker.checkNodes(node.Children)
+			if checker.lost {
+				return
+			}
+			if len(checker.stack) < depth {
+				checker.report(token.Loc, fmt.Sprintf("the list consumed %d values from the stack that were pushed before it was opened", depth-len(checker.stack)), checkNote(node.CloseLoc, "the list is closed here"))
+				depth = len(checker.stack)
+			}
+			list := knownValue(TokenList, token.Loc)
+			list.Elems = slices.Clone(checker.stack[depth:])
+			checker.stack = append(checker.stack[:depth], list)
+		case NodeToken:
+			switch token.Kind {
+			case TokenDash, TokenPlus, TokenAsterisk, TokenSlash:
+				checker.checkArithmetic(token)
+			case TokenFrames, TokenTimestamp:
+				checker.push(knownValue(TokenTimestamp, token.Loc))
+			case TokenString, TokenNumber, TokenBool:
+				value := knownValue(token.Kind, token.Loc)
+				value.Literal = node
+				checker.push(value)
+			case TokenSymbol:
+				checker.checkSymbol(token)
+			default:
+				checker.report(token.Loc, fmt.Sprintf("Unexpected token %s", TokenKindName[token.Kind]))
+			}
+		}
+	}
+}
+
+func (checker *Checker) checkFile(loc *Loc, filePath string, ignoreIfMissing bool) {
+	key := includeKey(filePath)
+	for _, frame := range checker.including {
+		if includeKey(frame.Path) == key {
+			if loc != nil {
+				checker.lose(*loc, fmt.Sprintf("include cycle: %s", includeChainToString(checker.including, filePath)))
+			}
+			return
+		}
+	}
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		if ignoreIfMissing && os.IsNotExist(err) {
+			return
+		}
+		if loc != nil {
+			checker.report(*loc, fmt.Sprintf("%s", err))
+		} else {
+			Diags.Error(Loc{}, "%s", err)
+			checker.Errors += 1
+		}
+		return
+	}
+	file := ParseMarkutContent(string(content), filePath)
+	if len(file.Errors) > 0 {
+		for _, err := range file.Errors {
+			Diags.Err(err)
+		}
+		checker.Errors += len(file.Errors)
+		checker.lose(Loc{FilePath: filePath}, "the file has syntax errors")
+		return
+	}
+	checker.included[key] = true
+	checker.including = append(checker.including, IncludeFrame{Loc: loc, Path: filePath})
+	checker.checkNodes(file.Nodes)
+	checker.including = checker.including[:len(checker.including)-1]
+}
+
+func (checker *Checker) finishCheck() {
+	if checker.lost {
+		return
+	}
+	for _, value := range checker.stack {
+		checker.report(value.Loc, "unused argument")
+	}
+}
+
+func checkSubcommand(name string, args []string) bool {
+	subFlag := flag.NewFlagSet(name, flag.ContinueOnError)
+	markutPtr := subFlag.String("markut", "MARKUT", "Path to the MARKUT file")
+
+	err := parseSubcommandFlags(subFlag, args)
+	if err == flag.ErrHelp {
+		return true
+	}
+
+	if err != nil {
+		Diags.Error(Loc{}, "Could not parse command line arguments: %s", err)
+		return false
+	}
+
+	checker := NewChecker()
+	if home, ok := os.LookupEnv("HOME"); ok {
+		checker.checkFile(nil, path.Join(home, ".markut"), true)
+	}
+	checker.checkFile(nil, *markutPtr, false)
+	checker.finishCheck()
+	if checker.Errors > 0 {
+		problems := "problems"
+		if checker.Errors == 1 {
+			problems = "problem"
+		}
+		Diags.Error(Loc{}, "found %d %s", checker.Errors, problems)
+		return false
+	}
+	return true
+}
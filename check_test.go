@@ -0,0 +1,137 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func checkMarkutContent(t *testing.T, content string) Checker {
+	filePath := filepath.Join(t.TempDir(), "MARKUT")
+	if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	checker := NewChecker()
+	checker.checkFile(nil, filePath, false)
+	checker.finishCheck()
+	return checker
+}
+
+func TestCheck(t *testing.T) {
+	cases := []struct {
+		content string
+		errors  int
+		lost    bool
+	}{
+		{content: "1:00 2:00 chunk", errors: 0},
+		{content: "1:00 chunk", errors: 1},
+		{content: "\"a\" 2:00 chunk", errors: 1},
+		{content: "1:00 2:00", errors: 2},
+		{content: "oops", errors: 1},
+		{content: "{ chunk } \"c\" define 1:00 c", errors: 1},
+		{content: "{ 1:00 } \"start\" define start 2:00 chunk", errors: 0},
+		{content: "1:00 \"intro\" let intro 2:00 chunk", errors: 0},
+		{content: "[ 1:00 2:00 ] { 0:10 + } map drop", errors: 0},
+		{content: "true { 1:00 } { \"a\" } if_else 2:00 chunk", errors: 1},
+		{content: "{ r } \"r\" define r", errors: 0, lost: true},
+		{content: "{ r } \"r\" define r 1:00 chunk", errors: 0, lost: true},
+	}
+	for _, c := range cases {
+		checker := checkMarkutContent(t, c.content)
+		if checker.Errors != c.errors {
+			t.Errorf("%s: expected %d errors but got %d", c.content, c.errors, checker.Errors)
+		}
+		if checker.lost != c.lost {
+			t.Errorf("%s: expected the checker to lose track of the stack: %t, but got %t", c.content, c.lost, checker.lost)
+		}
+	}
+}
+
+func TestCheckDiagnostics(t *testing.T) {
+	Diags.Flush()
+	reported := []Diag{}
+	Diags.Sink = func(diag Diag) {
+		reported = append(reported, diag)
+	}
+	defer func() {
+		Diags.Sink = nil
+	}()
+	checkMarkutContent(t, "1:00 oops\n{ r } \"r\" define r")
+	Diags.Flush()
+
+	if len(reported) != 2 {
+		t.Fatalf("expected 2 diagnostics but got %d: %+v", len(reported), reported)
+	}
+	if reported[0].Severity != SeverityError || len(reported[0].Notes) != 0 {
+		t.Errorf("expected the error about oops without notes but got %+v", reported[0])
+	}
+	if reported[1].Severity != SeverityWarning || reported[1].Name != "unchecked" {
+		t.Errorf("expected the unchecked warning but got %+v", reported[1])
+	}
+}
+
+func TestCheckWerror(t *testing.T) {
+	Diags.Werror = true
+	defer func() {
+		Diags.Werror = false
+	}()
+	checker := checkMarkutContent(t, "{ r } \"r\" define r")
+	if checker.Errors != 1 {
+		t.Errorf("expected the unchecked warning to be an error with -Werror but got %d errors", checker.Errors)
+	}
+}
+
+func TestCheckIncludes(t *testing.T) {
+	cases := []struct {
+		name   string
+		files  map[string]string
+		errors int
+		lost   bool
+	}{
+		{
+			name: "include_path",
+			files: map[string]string{
+				"MARKUT":       "\"lib\" include_path \"a.markut\" include 2:00 chunk",
+				"lib/a.markut": "1:00",
+			},
+			errors: 0,
+		},
+		{
+			name: "include_once",
+			files: map[string]string{
+				"MARKUT":   "\"a.markut\" include_once \"a.markut\" include_once 2:00 chunk",
+				"a.markut": "1:00",
+			},
+			errors: 0,
+		},
+		{
+			name: "include cycle",
+			files: map[string]string{
+				"MARKUT":   "\"a.markut\" include",
+				"a.markut": "\"MARKUT\" include",
+			},
+			errors: 0,
+			lost:   true,
+		},
+		{
+			name: "error in the included file",
+			files: map[string]string{
+				"MARKUT":       "\"sub/a.markut\" include",
+				"sub/a.markut": "1:00 chunk",
+			},
+			errors: 1,
+		},
+	}
+	for _, c := range cases {
+		dir := writeTestFiles(t, c.files)
+		checker := NewChecker()
+		checker.checkFile(nil, filepath.Join(dir, "MARKUT"), false)
+		checker.finishCheck()
+		if checker.Errors != c.errors {
+			t.Errorf("%s: expected %d errors but got %d", c.name, c.errors, checker.Errors)
+		}
+		if checker.lost != c.lost {
+			t.Errorf("%s: expected the checker to lose track of the stack: %t, but got %t", c.name, c.lost, checker.lost)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+type Severity int
+
+const (
+	SeverityError Severity = iota
+	SeverityWarning
+	SeverityNote
+	// Something that is not implemented yet. Fails just like an error.
+	SeverityTodo
+)
+
+var SeverityNames = map[Severity]string{
+	SeverityError:   "ERROR",
+	SeverityWarning: "WARNING",
+	SeverityNote:    "NOTE",
+	SeverityTodo:    "TODO",
+}
+
+var SeverityColors = map[Severity]string{
+	SeverityError:   "\033[1;31m",
+	SeverityWarning: "\033[1;33m",
+	SeverityNote:    "\033[1;36m",
+	SeverityTodo:    "\033[1;35m",
+}
+
+const ColorReset = "\033[0m"
+
+type Diag struct {
+	Severity Severity
+	// The zero Loc means that the diagnostic is not related to any location
+	Loc     Loc
+	Message string
+	// Name of the warning used by the -Wno-<name> flag. Only for warnings.
+	Name string
+	// Optional excerpt of the source line. See DiagErr.
+	Line  string
+	Len   int
+	Notes []Diag
+}
+
+func (diag Diag) HasLoc() bool {
+	return diag.Loc != Loc{}
+}
+
+// The single place where all the errors, warnings and notes of Markut end up.
+// The notes are attached to an error or warning through the Report returned
+// when it is reported.
+type Diagnostics struct {
+	// "text" or "json"
+	Format string
+	Color  bool
+	Werror bool
+	// Names of the suppressed warnings
+	Disabled map[string]bool
+	Output   io.Writer
+	// If set, receives the diagnostics instead of them being printed
+	Sink     func(diag Diag)
+	Errors   int
+	Warnings int
+	// The last reported diagnostic. Kept around until the next one, so the
+	// notes can be attached to it before it is handed over to the Sink or
+	// printed as JSON.
+	pending *Diag
+}
+
+// The error or warning that was just reported. Used to attach the notes to it.
+type Report struct {
+	diags *Diagnostics
+	// nil if the warning is suppressed. Its notes are suppressed as well.
+	diag *Diag
+	// The reported diagnostic is an error, or a warning turned into an error
+	// by -Werror
+	Fatal bool
+}
+
+var Diags = Diagnostics{
+	Format:   "text",
+	Color:    isTerminal(os.Stderr),
+	Output:   os.Stderr,
+	Disabled: map[string]bool{},
+}
+
+var DiagFlagsUsage = []string{
+	"-diagnostics=text|json    Format of the reported errors and warnings. json prints one object per line",
+	"-color=auto|always|never  Colorize the reported errors and warnings",
+	"-Werror                   Treat the warnings as errors",
+	"-Wno-<name>               Do not report the warning <name>",
+}
+
+// Picks up the diagnostic flags among the flags of a subcommand, so they are
+// accepted by all the subcommands. The arguments are scanned the same way
+// flagSet.Parse scans them: up to the first non-flag argument or "--",
+// stepping over the values of the flagSet's own flags. Returns the rest of
+// the arguments to be parsed by flagSet.
+func (diags *Diagnostics) ParseFlags(flagSet *flag.FlagSet, args []string) (rest []string, err error) {
+	for i := 0; i < len(args); i += 1 {
+		arg := args[i]
+		if arg == "--" || len(arg) < 2 || arg[0] != '-' {
+			return append(rest, args[i:]...), nil
+		}
+		switch {
+		case strings.HasPrefix(arg, "-diagnostics="):
+			diags.Format = strings.TrimPrefix(arg, "-diagnostics=")
+			if diags.Format != "text" && diags.Format != "json" {
+				return nil, fmt.Errorf("unknown diagnostics format %s. Expected text or json", diags.Format)
+			}
+		case strings.HasPrefix(arg, "-color="):
+			switch color := strings.TrimPrefix(arg, "-color="); color {
+			case "auto":
+				diags.Color = isTerminal(os.Stderr)
+			case "always":
+				diags.Color = true
+			case "never":
+				diags.Color = false
+			default:
+				return nil, fmt.Errorf("unknown color mode %s. Expected auto, always or never", color)
+			}
+		case arg == "-Werror":
+			diags.Werror = true
+		case strings.HasPrefix(arg, "-Wno-") && len(arg) > len("-Wno-"):
+			diags.Disabled[strings.TrimPrefix(arg, "-Wno-")] = true
+		default:
+			rest = append(rest, arg)
+			// The value of the flag is the next argument unless it is a
+			// boolean flag or the value is provided after "="
+			name := strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+			if strings.Contains(name, "=") {
+				continue
+			}
+			if f := flagSet.Lookup(name); f != nil && i+1 < len(args) {
+				if boolFlag, ok := f.Value.(interface{ IsBoolFlag() bool }); !ok || !boolFlag.IsBoolFlag() {
+					i += 1
+					rest = append(rest, args[i])
+				}
+			}
+		}
+	}
+	return rest, nil
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func (diags *Diagnostics) Error(loc Loc, format string, args ...any) Report {
+	return diags.report(Diag{Severity: SeverityError, Loc: loc, Message: fmt.Sprintf(format, args...)})
+}
+
+func (diags *Diagnostics) Todo(loc Loc, format string, args ...any) Report {
+	return diags.report(Diag{Severity: SeverityTodo, Loc: loc, Message: fmt.Sprintf(format, args...)})
+}
+
+// The warning is fatal if it is turned into an error by -Werror
+func (diags *Diagnostics) Warning(name string, loc Loc, format string, args ...any) Report {
+	if diags.Disabled[name] {
+		return Report{diags: diags}
+	}
+	diag := Diag{Severity: SeverityWarning, Loc: loc, Message: fmt.Sprintf(format, args...), Name: name}
+	if diags.Werror {
+		diag.Severity = SeverityError
+	}
+	return diags.report(diag)
+}
+
+// Reports the error returned by something like the lexer. DiagErrs keep
+// their location and the excerpt of the source line.
+func (diags *Diagnostics) Err(err error) Report {
+	return diags.report(errToDiag(SeverityError, err))
+}
+
+// Reports a note that is not related to any error or warning
+func (diags *Diagnostics) Note(loc Loc, format string, args ...any) {
+	diags.report(Diag{Severity: SeverityNote, Loc: loc, Message: fmt.Sprintf(format, args...)})
+}
+
+// Attaches a note to the reported error or warning
+func (report Report) Note(loc Loc, format string, args ...any) Report {
+	report.note(Diag{Severity: SeverityNote, Loc: loc, Message: fmt.Sprintf(format, args...)})
+	return report
+}
+
+// Same as Note but for the errors like the ones returned by the type checking
+func (report Report) NoteErr(err error) Report {
+	report.note(errToDiag(SeverityNote, err))
+	return report
+}
+
+func errToDiag(severity Severity, err error) Diag {
+	var diagErr *DiagErr
+	if errors.As(err, &diagErr) {
+		return Diag{
+			Severity: severity,
+			Loc:      diagErr.Loc,
+			Message:  fmt.Sprintf("%s", diagErr.Err),
+			Line:     diagErr.Line,
+			Len:      diagErr.Len,
+		}
+	}
+	return Diag{Severity: severity, Message: fmt.Sprintf("%s", err)}
+}
+
+func (diags *Diagnostics) report(diag Diag) Report {
+	diags.Flush()
+	fatal := false
+	switch diag.Severity {
+	case SeverityWarning:
+		diags.Warnings += 1
+	case SeverityError, SeverityTodo:
+		diags.Errors += 1
+		fatal = true
+	}
+	if diags.Sink == nil && diags.Format == "text" {
+		diags.printText(diags.Output, diag)
+	}
+	diags.pending = &diag
+	return Report{diags: diags, diag: &diag, Fatal: fatal}
+}
+
+func (report Report) note(diag Diag) {
+	diags := report.diags
+	if report.diag == nil {
+		return
+	}
+	// Something else was reported since then and the diagnostic is already
+	// handed over, so the note can only be reported on its own
+	if report.diag != diags.pending {
+		diags.report(diag)
+		return
+	}
+	if diags.Sink == nil && diags.Format == "text" {
+		diags.printText(diags.Output, diag)
+	}
+	report.diag.Notes = append(report.diag.Notes, diag)
+}
+
+// Hands over the last error or warning along with its notes. Must be called
+// before exiting, so nothing is lost.
+func (diags *Diagnostics) Flush() {
+	if diags.pending == nil {
+		return
+	}
+	diag := *diags.pending
+	diags.pending = nil
+	if diags.Sink != nil {
+		diags.Sink(diag)
+		return
+	}
+	if diags.Format == "json" {
+		// The messages quote the kinds like <timestamp> a lot, so no HTML escaping
+		encoder := json.NewEncoder(diags.Output)
+		encoder.SetEscapeHTML(false)
+		if err := encoder.Encode(diagToJSON(diag)); err != nil {
+			// There is nowhere else to report it, so at least the text is
+			// not lost
+			fmt.Fprintf(os.Stderr, "ERROR: could not report the diagnostic as JSON: %s\n", err)
+			diags.printText(os.Stderr, diag)
+			for _, note := range diag.Notes {
+				diags.printText(os.Stderr, note)
+			}
+		}
+	}
+}
+
+func (diags *Diagnostics) printText(output io.Writer, diag Diag) {
+	sb := strings.Builder{}
+	if diag.HasLoc() {
+		fmt.Fprintf(&sb, "%s: ", diag.Loc)
+	}
+	label := SeverityNames[diag.Severity]
+	if diags.Color {
+		label = SeverityColors[diag.Severity] + label + ColorReset
+	}
+	fmt.Fprintf(&sb, "%s: %s", label, diag.Message)
+	if diag.Name != "" {
+		fmt.Fprintf(&sb, " [-W%s]", diag.Name)
+	}
+	if len(diag.Line) > 0 {
+		sb.WriteString(sourceExcerpt(diag.Line, diag.Loc.Col, diag.Len))
+	}
+	fmt.Fprintf(output, "%s\n", sb.String())
+}
+
+type DiagJSON struct {
+	Severity string     `json:"severity"`
+	File     string     `json:"file,omitempty"`
+	Line     int        `json:"line,omitempty"`
+	Column   int        `json:"column,omitempty"`
+	Length   int        `json:"length,omitempty"`
+	Message  string     `json:"message"`
+	Name     string     `json:"name,omitempty"`
+	Notes    []DiagJSON `json:"notes,omitempty"`
+}
+
+func diagToJSON(diag Diag) DiagJSON {
+	result := DiagJSON{
+		Severity: strings.ToLower(SeverityNames[diag.Severity]),
+		Length:   diag.Len,
+		Message:  diag.Message,
+		Name:     diag.Name,
+	}
+	if diag.HasLoc() {
+		result.File = diag.Loc.FilePath
+		result.Line = diag.Loc.Row + 1
+		result.Column = diag.Loc.Col + 1
+	}
+	for _, note := range diag.Notes {
+		result.Notes = append(result.Notes, diagToJSON(note))
+	}
+	return result
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func newTestDiagnostics(format string) (*Diagnostics, *bytes.Buffer) {
+	output := &bytes.Buffer{}
+	return &Diagnostics{
+		Format:   format,
+		Output:   output,
+		Disabled: map[string]bool{},
+	}, output
+}
+
+func decodeDiagsJSON(t *testing.T, output *bytes.Buffer) (diags []DiagJSON) {
+	decoder := json.NewDecoder(output)
+	for decoder.More() {
+		var diag DiagJSON
+		if err := decoder.Decode(&diag); err != nil {
+			t.Fatalf("could not decode the diagnostics: %s", err)
+		}
+		diags = append(diags, diag)
+	}
+	return
+}
+
+func TestDiagnosticsJSON(t *testing.T) {
+	diags, output := newTestDiagnostics("json")
+	loc := Loc{FilePath: "MARKUT", Row: 1, Col: 4}
+	diags.Error(loc, "Unknown command %s", "oops").
+		Note(Loc{FilePath: "MARKUT", Row: 0, Col: 0}, "the word is defined here")
+	diags.Warning("missing-include", Loc{}, "no such file")
+	diags.Flush()
+
+	expected := []DiagJSON{
+		{
+			Severity: "error",
+			File:     "MARKUT",
+			Line:     2,
+			Column:   5,
+			Message:  "Unknown command oops",
+			Notes: []DiagJSON{
+				{Severity: "note", File: "MARKUT", Line: 1, Column: 1, Message: "the word is defined here"},
+			},
+		},
+		{Severity: "warning", Message: "no such file", Name: "missing-include"},
+	}
+	actual := decodeDiagsJSON(t, output)
+	if !slices.EqualFunc(actual, expected, diagJSONEqual) {
+		t.Errorf("expected %+v but got %+v", expected, actual)
+	}
+	if diags.Errors != 1 || diags.Warnings != 1 {
+		t.Errorf("expected 1 error and 1 warning but got %d and %d", diags.Errors, diags.Warnings)
+	}
+}
+
+func diagJSONEqual(a DiagJSON, b DiagJSON) bool {
+	return a.Severity == b.Severity &&
+		a.File == b.File &&
+		a.Line == b.Line &&
+		a.Column == b.Column &&
+		a.Length == b.Length &&
+		a.Message == b.Message &&
+		a.Name == b.Name &&
+		slices.EqualFunc(a.Notes, b.Notes, diagJSONEqual)
+}
+
+func TestDiagnosticsNotes(t *testing.T) {
+	cases := []struct {
+		name     string
+		report   func(diags *Diagnostics)
+		expected []string
+	}{
+		{
+			name: "note of the reported error",
+			report: func(diags *Diagnostics) {
+				diags.Error(Loc{}, "a").Note(Loc{}, "of a")
+			},
+			expected: []string{"error a [of a]"},
+		},
+		{
+			name: "standalone note after an error",
+			report: func(diags *Diagnostics) {
+				diags.Error(Loc{}, "a")
+				diags.Note(Loc{}, "standalone")
+			},
+			expected: []string{"error a", "note standalone"},
+		},
+		{
+			name: "note of an error reported before another one",
+			report: func(diags *Diagnostics) {
+				a := diags.Error(Loc{}, "a")
+				diags.Error(Loc{}, "b")
+				a.Note(Loc{}, "of a")
+			},
+			expected: []string{"error a", "error b", "note of a"},
+		},
+		{
+			name: "notes of a suppressed warning",
+			report: func(diags *Diagnostics) {
+				diags.Error(Loc{}, "a")
+				diags.Warning("disabled", Loc{}, "w").Note(Loc{}, "of w")
+				diags.Note(Loc{}, "standalone")
+			},
+			expected: []string{"error a", "note standalone"},
+		},
+	}
+	for _, c := range cases {
+		diags, output := newTestDiagnostics("json")
+		diags.Disabled["disabled"] = true
+		c.report(diags)
+		diags.Flush()
+		actual := []string{}
+		for _, diag := range decodeDiagsJSON(t, output) {
+			s := diag.Severity + " " + diag.Message
+			for _, note := range diag.Notes {
+				s += " [" + note.Message + "]"
+			}
+			actual = append(actual, s)
+		}
+		if !slices.Equal(actual, c.expected) {
+			t.Errorf("%s: expected %q but got %q", c.name, c.expected, actual)
+		}
+	}
+}
+
+func TestDiagnosticsWerror(t *testing.T) {
+	diags, output := newTestDiagnostics("text")
+	if diags.Warning("w", Loc{}, "warning").Fatal {
+		t.Errorf("expected the warning not to be fatal without -Werror")
+	}
+	diags.Werror = true
+	if !diags.Warning("w", Loc{}, "warning").Fatal {
+		t.Errorf("expected the warning to be fatal with -Werror")
+	}
+	diags.Disabled["w"] = true
+	if diags.Warning("w", Loc{}, "warning").Fatal {
+		t.Errorf("expected the suppressed warning not to be fatal even with -Werror")
+	}
+	expected := "WARNING: warning [-Ww]\nERROR: warning [-Ww]\n"
+	if output.String() != expected {
+		t.Errorf("expected\n%s\nbut got\n%s", expected, output.String())
+	}
+	if diags.Errors != 1 || diags.Warnings != 1 {
+		t.Errorf("expected 1 error and 1 warning but got %d and %d", diags.Errors, diags.Warnings)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("the output is closed")
+}
+
+func TestDiagnosticsJSONOutputFailure(t *testing.T) {
+	diags := &Diagnostics{
+		Format:   "json",
+		Output:   failingWriter{},
+		Disabled: map[string]bool{},
+	}
+	diags.Error(Loc{}, "a").Note(Loc{}, "of a")
+	diags.Error(Loc{}, "b")
+	diags.Flush()
+	if diags.Errors != 2 {
+		t.Errorf("expected 2 errors but got %d", diags.Errors)
+	}
+}
+
+func TestDiagnosticsParseFlags(t *testing.T) {
+	cases := []struct {
+		args     []string
+		rest     []string
+		format   string
+		werror   bool
+		disabled []string
+	}{
+		{args: []string{"-Werror", "-markut", "MARKUT"}, rest: []string{"-markut", "MARKUT"}, format: "text", werror: true},
+		{args: []string{"-diagnostics=json", "-Wno-cut-failed"}, format: "json", disabled: []string{"cut-failed"}},
+		{args: []string{"-markut", "-Werror"}, rest: []string{"-markut", "-Werror"}, format: "text"},
+		{args: []string{"-y", "-Werror"}, rest: []string{"-y"}, format: "text", werror: true},
+		{args: []string{"--", "-Werror"}, rest: []string{"--", "-Werror"}, format: "text"},
+		{args: []string{"input.mp4", "-Werror"}, rest: []string{"input.mp4", "-Werror"}, format: "text"},
+	}
+	for _, c := range cases {
+		diags, _ := newTestDiagnostics("text")
+		flagSet := flag.NewFlagSet("test", flag.ContinueOnError)
+		flagSet.String("markut", "MARKUT", "")
+		flagSet.Bool("y", false, "")
+		rest, err := diags.ParseFlags(flagSet, c.args)
+		name := strings.Join(c.args, " ")
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", name, err)
+			continue
+		}
+		if !slices.Equal(rest, c.rest) {
+			t.Errorf("%s: expected the rest %q but got %q", name, c.rest, rest)
+		}
+		if diags.Format != c.format || diags.Werror != c.werror {
+			t.Errorf("%s: expected format %s and -Werror %t but got %s and %t", name, c.format, c.werror, diags.Format, diags.Werror)
+		}
+		for _, disabled := range c.disabled {
+			if !diags.Disabled[disabled] {
+				t.Errorf("%s: expected the warning %s to be disabled", name, disabled)
+			}
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// Canonical layout of the MARKUT files produced by `markut fmt`:
+// - tokens are separated by a single space,
+// - the line breaks of the original file are preserved, but several empty lines in a row are collapsed into one,
+// - a line never contains more than one chunk definition,
+// - the content of the blocks and the lists spanning several lines is indented with 4 spaces,
+// - timestamps are normalized to HH:MM:SS.mmm, while durations, frames and SMPTE timecode are left as is,
+// - string literals always use double quotes,
+// - trailing comments of the consecutive lines are aligned.
+
+const FmtIndent = "    "
+
+func quoteStrLit(lit []rune) string {
+	sb := strings.Builder{}
+	sb.WriteRune('"')
+	for _, ch := range lit {
+		switch ch {
+		case '"':
+			sb.WriteString("\\\"")
+		case '\\':
+			sb.WriteString("\\\\")
+		case '\n':
+			sb.WriteString("\\n")
+		case '\r':
+			sb.WriteString("\\r")
+		case 0:
+			sb.WriteString("\\0")
+		default:
+			if ch < 0x20 || ch == 0x7f {
+				fmt.Fprintf(&sb, "\\x%02x", ch)
+			} else {
+				sb.WriteRune(ch)
+			}
+		}
+	}
+	sb.WriteRune('"')
+	return sb.String()
+}
+
+func fmtToken(token Token) string {
+	switch token.Kind {
+	case TokenTimestamp:
+		if strings.ContainsFunc(string(token.Text), unicode.IsLetter) {
+			// Durations like 5m30s are written for readability, so we keep them
+			return string(token.Text)
+		}
+		return millisToTs(token.Timestamp)
+	case TokenString:
+		return quoteStrLit(token.Text)
+	case TokenComment:
+		return strings.TrimRightFunc(string(token.Text), unicode.IsSpace)
+	default:
+		return string(token.Text)
+	}
+}
+
+// Funcs that modify the last defined chunk and are kept on the same line with it
+func isChunkModifier(token Token) bool {
+	if token.Kind != TokenSymbol {
+		return false
+	}
+	f, ok := funcs[string(token.Text)]
+	return ok && f.Category == "Chunk" && len(f.Signature.Ins) == 0
+}
+
+type FmtLine struct {
+	Depth   int
+	Code    []string
+	Comment string
+	Blank   bool
+}
+
+func (line FmtLine) CodeString() string {
+	return strings.Repeat(FmtIndent, line.Depth) + strings.Join(line.Code, " ")
+}
+
+// Lays out the nodes of the syntax tree into lines. The line breaks of the
+// original file are recovered from the Locs of the nodes.
+type Formatter struct {
+	lines      []FmtLine
+	line       FmtLine
+	depth      int
+	chunkBreak bool
+	// Where the previously written token ends. nil at the start of the file.
+	prevEnd *Loc
+}
+
+func (formatter *Formatter) flush() {
+	if len(formatter.line.Code) > 0 || len(formatter.line.Comment) > 0 {
+		formatter.lines = append(formatter.lines, formatter.line)
+	}
+	formatter.line = FmtLine{Depth: formatter.depth}
+	formatter.chunkBreak = false
+}
+
+// Writes a single token of the original file that ends right before `end`
+func (formatter *Formatter) writeToken(token Token, end Loc) {
+	if formatter.prevEnd != nil && token.Loc.Row > formatter.prevEnd.Row {
+		formatter.flush()
+		if token.Loc.Row-formatter.prevEnd.Row >= 2 {
+			formatter.lines = append(formatter.lines, FmtLine{Blank: true})
+		}
+	}
+	formatter.prevEnd = &end
+
+	isClose := token.Kind == TokenCurlyClose || token.Kind == TokenBracketClose
+	if formatter.chunkBreak && len(formatter.line.Code) > 0 && token.Kind != TokenComment {
+		if isClose {
+			formatter.chunkBreak = false
+		} else if !isChunkModifier(token) {
+			formatter.flush()
+		}
+	}
+
+	if isClose {
+		formatter.depth = max(formatter.depth-1, 0)
+		if len(formatter.line.Code) == 0 {
+			formatter.line.Depth = formatter.depth
+		}
+	}
+
+	if token.Kind == TokenComment && strings.HasPrefix(string(token.Text), "//") && len(formatter.line.Code) > 0 {
+		formatter.line.Comment = fmtToken(token)
+	} else {
+		formatter.line.Code = append(formatter.line.Code, fmtToken(token))
+	}
+
+	switch token.Kind {
+	case TokenCurlyOpen, TokenBracketOpen:
+		formatter.depth += 1
+	case TokenSymbol:
+		if string(token.Text) == "chunk" {
+			formatter.chunkBreak = true
+		}
+	}
+}
+
+func (formatter *Formatter) writeNodes(nodes []Node) {
+	for _, node := range nodes {
+		switch node.Kind {
+		case NodeToken, NodeComment:
+			formatter.writeToken(node.Token, node.End)
+		case NodeBlock, NodeList:
+			open := node.Token.Loc
+			open.Col += len(node.Token.Text)
+			formatter.writeToken(node.Token, open)
+			formatter.writeNodes(node.Children)
+			close := Token{
+				Kind: ClosingKinds[node.Token.Kind],
+				Text: []rune("}"),
+				Loc:  node.CloseLoc,
+			}
+			if node.Kind == NodeList {
+				close.Text = []rune("]")
+			}
+			formatter.writeToken(close, node.End)
+		default:
+			panic("unreachable")
+		}
+	}
+}
+
+func formatMarkut(content string, path string) (string, error) {
+	file := ParseMarkutContent(content, path)
+	if len(file.Errors) > 0 {
+		return "", file.Errors[0]
+	}
+
+	formatter := Formatter{}
+	formatter.writeNodes(file.Nodes)
+	formatter.flush()
+	lines := formatter.lines
+
+	// Align trailing comments of the consecutive lines
+	for i := 0; i < len(lines); {
+		if len(lines[i].Comment) == 0 {
+			i += 1
+			continue
+		}
+		j := i
+		width := 0
+		for j < len(lines) && len(lines[j].Comment) > 0 && !strings.Contains(lines[j].CodeString(), "\n") {
+			width = max(width, len([]rune(lines[j].CodeString())))
+			j += 1
+		}
+		if j == i {
+			j = i + 1
+		}
+		for k := i; k < j; k += 1 {
+			code := lines[k].CodeString()
+			lines[k].Comment = strings.Repeat(" ", max(width-len([]rune(code)), 0)+1) + lines[k].Comment
+		}
+		i = j
+	}
+
+	sb := strings.Builder{}
+	for _, line := range lines {
+		if !line.Blank {
+			sb.WriteString(line.CodeString())
+			sb.WriteString(line.Comment)
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String(), nil
+}
+
+func fmtSubcommand(name string, args []string) bool {
+	subFlag := flag.NewFlagSet(name, flag.ContinueOnError)
+	markutPtr := subFlag.String("markut", "MARKUT", "Path to the MARKUT file. Ignored if the files are provided as positional arguments")
+	checkPtr := subFlag.Bool("check", false, "Do not modify the files, just fail if any of them is not formatted")
+
+	err := parseSubcommandFlags(subFlag, args)
+	if err == flag.ErrHelp {
+		return true
+	}
+
+	if err != nil {
+		Diags.Error(Loc{}, "Could not parse command line arguments: %s", err)
+		return false
+	}
+
+	paths := subFlag.Args()
+	if len(paths) == 0 {
+		paths = []string{*markutPtr}
+	}
+
+	ok := true
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			Diags.Error(Loc{}, "Could not read file %s: %s", path, err)
+			ok = false
+			continue
+		}
+		formatted, err := formatMarkut(string(content), path)
+		if err != nil {
+			Diags.Err(err)
+			ok = false
+			continue
+		}
+		if formatted == string(content) {
+			continue
+		}
+		if *checkPtr {
+			Diags.Error(Loc{FilePath: path}, "the file is not formatted. Run `markut fmt %s` to fix it", path)
+			ok = false
+			continue
+		}
+		err = os.WriteFile(path, []byte(formatted), 0644)
+		if err != nil {
+			Diags.Error(Loc{}, "Could not write file %s: %s", path, err)
+			ok = false
+			continue
+		}
+		fmt.Printf("Formatted %s\n", path)
+	}
+	return ok
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+)
+
+var fmtInputs = []string{
+	`// header comment
+
+
+"input.mp4"   input    // the input
+1:00  1:30 chunk 2:00 2:30 chunk 'single' "x" concat   /* block */ 3:00 3:10 chunk
+{ dup
+  #1 +
+} "name" define
+[ 1:00 5m30s
+  00:01:00:12 1234f ]
+  "a" { "b" chunk } if
+/* multi
+   line */
+#3.25 #2 * drop      // trailing
+   [ [ 1 2 ] [
+  3 ] ]   // x
+    // stray
+{ 1:00 2:00 chunk 3:00 4:00 chunk } { } [ ]
+`,
+	`{ 1:00 2:00 chunk 3:00 4:00 chunk
+}    // c
+ [1 2
+ ]  // d
+`,
+	"",
+	"1:00 2:00 chunk",
+}
+
+func TestFormatMarkut(t *testing.T) {
+	input := "\"input.mp4\"   input    // the input\n1:00  1:30 chunk   // the intro\n2:00 2:30 chunk\n\n\n[ 5m30s\n1234f ] // list\n"
+	expected := "\"input.mp4\" input               // the input\n00:01:00.000 00:01:30.000 chunk // the intro\n00:02:00.000 00:02:30.000 chunk\n\n[ 5m30s\n    1234f ] // list\n"
+	formatted, err := formatMarkut(input, "test.markut")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if formatted != expected {
+		t.Errorf("expected\n%s\nbut got\n%s", expected, formatted)
+	}
+}
+
+func TestFormatMarkutIsIdempotent(t *testing.T) {
+	for _, input := range fmtInputs {
+		formatted, err := formatMarkut(input, "test.markut")
+		if err != nil {
+			t.Errorf("unexpected error: %s\n%s", err, input)
+			continue
+		}
+		again, err := formatMarkut(formatted, "test.markut")
+		if err != nil {
+			t.Errorf("unexpected error on the formatted file: %s\n%s", err, formatted)
+			continue
+		}
+		if again != formatted {
+			t.Errorf("formatting the formatted file changed it from\n%s\nto\n%s", formatted, again)
+		}
+	}
+}
+
+func TestFormatMarkutSyntaxError(t *testing.T) {
+	inputs := []string{
+		"\"input.mp4 input",
+		"1:00 0:61:00 chunk",
+		"{ 1:00 2:00 chunk",
+		"[ 1:00 } ]",
+	}
+	for _, input := range inputs {
+		if _, err := formatMarkut(input, "test.markut"); err == nil {
+			t.Errorf("%s: expected an error", input)
+		}
+	}
+}
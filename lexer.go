@@ -1,7 +1,9 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"slices"
 	"unicode"
 	"strings"
 	"strconv"
@@ -9,69 +11,221 @@ import (
 
 type Millis int64
 
-// TODO: we really need more precise error reported for timestamp tokens.
-// Like the diagnostics should point out at specific characters that are
-// incorrect.
+// Error in a timestamp literal that points at the specific incorrect
+// characters of it.
+type TimestampErr struct {
+	Offset int
+	Len    int
+	Err    error
+}
 
-func parseSsAndMs(s string) (ss int64, ms Millis, err error) {
-	switch comps := strings.Split(s, "."); len(comps) {
-	case 2:
-		ss, err = strconv.ParseInt(comps[0], 10, 64);
-		if err != nil {
-			return
+func (err *TimestampErr) Error() string {
+	return err.Err.Error()
+}
+
+// Maximum amount of digits in a single component of a timestamp. Protects
+// the components from overflowing int64.
+const MaxTimestampComponentDigits = 12
+
+func IsDigit(ch rune) bool {
+	return '0' <= ch && ch <= '9'
+}
+
+type DurationUnit struct {
+	Name   string
+	Millis Millis
+}
+
+// Units of the duration literals in the order they must appear in
+var DurationUnits = []DurationUnit{
+	{Name: "h", Millis: 60 * 60 * 1000},
+	{Name: "m", Millis: 60 * 1000},
+	{Name: "s", Millis: 1000},
+	{Name: "ms", Millis: 1},
+}
+
+// Parses human readable durations like 90s, 5m30s, 1h2m, 250ms etc
+func durationToMillis(ts string) (Millis, error) {
+	runes := []rune(ts)
+	fail := func(offset int, n int, format string, args ...any) (Millis, error) {
+		return 0, &TimestampErr{
+			Offset: offset,
+			Len:    n,
+			Err:    fmt.Errorf(format, args...),
+		}
+	}
+
+	var result Millis = 0
+	nextUnit := 0
+	i := 0
+	for i < len(runes) {
+		begin := i
+		var value int64 = 0
+		for i < len(runes) && IsDigit(runes[i]) {
+			if i-begin >= MaxTimestampComponentDigits {
+				return fail(begin, i-begin+1, "The amount is too big")
+			}
+			value = value*10 + int64(runes[i]-'0')
+			i += 1
+		}
+		if i == begin {
+			return fail(i, 1, "Expected a digit but got `%c`", runes[i])
+		}
+
+		unitBegin := i
+		for i < len(runes) && unicode.IsLetter(runes[i]) {
+			i += 1
 		}
-		runes := []rune(comps[1])
-		ms = 0
-		for i := 0; i < 3; i += 1 {
-			ms = ms*10
+		if i == unitBegin {
 			if i < len(runes) {
-				 ms += Millis(runes[i] - '0')
+				return fail(i, 1, "Expected a unit but got `%c`", runes[i])
 			}
+			return fail(begin, i-begin, "Expected a unit after the amount. Available units are h, m, s and ms")
 		}
+		unit := string(runes[unitBegin:i])
+		index := slices.IndexFunc(DurationUnits, func(u DurationUnit) bool {
+			return u.Name == unit
+		})
+		if index < 0 {
+			return fail(unitBegin, i-unitBegin, "Unknown unit `%s`. Available units are h, m, s and ms", unit)
+		}
+		if index < nextUnit {
+			return fail(unitBegin, i-unitBegin, "Unit `%s` is out of order. The units must go from the biggest to the smallest and appear at most once", unit)
+		}
+		nextUnit = index + 1
+		result += Millis(value) * DurationUnits[index].Millis
+	}
+	return result, nil
+}
+
+// Parses SMPTE timecode of the form HH:MM:SS:FF. Returns the HH:MM:SS part in
+// milliseconds and the FF part separately, because the frames can be converted
+// to milliseconds only when the frame rate is known.
+func smpteToMillis(ts []rune) (ms Millis, frames int64, ok bool) {
+	comps := strings.Split(string(ts), ":")
+	if len(comps) != 4 {
 		return
-	case 1:
-		ss, err = strconv.ParseInt(comps[0], 10, 64);
-		if err != nil {
+	}
+	values := []int64{}
+	for _, comp := range comps {
+		if len(comp) != 2 || !IsDigit(rune(comp[0])) || !IsDigit(rune(comp[1])) {
 			return
 		}
-		ms = 0
-		return
-	default:
-		err = fmt.Errorf("Unexpected amount of components in the seconds (%d): %s", len(comps), s)
+		values = append(values, int64(comp[0]-'0')*10+int64(comp[1]-'0'))
+	}
+	if values[1] >= 60 || values[2] >= 60 {
 		return
 	}
+	ms = 60*60*1000*Millis(values[0]) + 60*1000*Millis(values[1]) + 1000*Millis(values[2])
+	frames = values[3]
+	ok = true
+	return
 }
 
+// Parses timestamps of the form [[HH:]MM:]SS[.mmm]
 func tsToMillis(ts string) (Millis, error) {
-	var err error = nil
-	var mm, hh, ss int64 = 0, 0, 0
+	runes := []rune(ts)
+	fail := func(offset int, n int, format string, args ...any) (Millis, error) {
+		return 0, &TimestampErr{
+			Offset: offset,
+			Len:    n,
+			Err:    fmt.Errorf(format, args...),
+		}
+	}
+	unexpected := func(i int) (Millis, error) {
+		if i < len(runes) {
+			return fail(i, 1, "Expected a digit but got `%c`", runes[i])
+		}
+		return fail(i, 1, "Expected a digit after `%c`", runes[i-1])
+	}
+
+	comps := []int64{}
+	begins := []int{}
 	var ms Millis = 0
-	index := 0
-	switch comps := strings.Split(ts, ":"); len(comps) {
-	case 3:
-		hh, err = strconv.ParseInt(comps[index], 10, 64)
-		if err != nil {
-			return 0, err
+	i := 0
+loop:
+	for {
+		begin := i
+		var value int64 = 0
+		for i < len(runes) && IsDigit(runes[i]) {
+			if i-begin >= MaxTimestampComponentDigits {
+				return fail(begin, i-begin+1, "Timestamp component is too big")
+			}
+			value = value*10 + int64(runes[i]-'0')
+			i += 1
 		}
-		index += 1
-		fallthrough
-	case 2:
-		mm, err = strconv.ParseInt(comps[index], 10, 64)
-		if err != nil {
-			return 0, err
+		if i == begin {
+			return unexpected(i)
 		}
-		index += 1
-		fallthrough
-	case 1:
-		ss, ms, err = parseSsAndMs(comps[index])
-		if err != nil {
-			return 0, err
+		comps = append(comps, value)
+		begins = append(begins, begin)
+
+		if i >= len(runes) {
+			break loop
+		}
+
+		switch runes[i] {
+		case ':':
+			if len(comps) >= 3 {
+				return fail(i, len(runes)-i, "Too many components in the timestamp. Expected at most 3 of them like HH:MM:SS or exactly 4 two-digit ones like HH:MM:SS:FF for SMPTE timecode")
+			}
+			i += 1
+		case '.':
+			i += 1
+			fracBegin := i
+			for i < len(runes) && IsDigit(runes[i]) {
+				if i-fracBegin >= 3 {
+					end := i
+					for end < len(runes) && IsDigit(runes[end]) {
+						end += 1
+					}
+					return fail(i, end-i, "Too many digits in the fractional part of the seconds. Expected at most 3 digits of milliseconds")
+				}
+				ms = ms*10 + Millis(runes[i]-'0')
+				i += 1
+			}
+			if i == fracBegin {
+				return unexpected(i)
+			}
+			for k := i - fracBegin; k < 3; k += 1 {
+				ms = ms * 10
+			}
+			if i < len(runes) {
+				if runes[i] == ':' {
+					return fail(i, 1, "The fractional part of the seconds must be at the end of the timestamp")
+				}
+				return fail(i, 1, "Unexpected `%c` after the fractional part of the seconds", runes[i])
+			}
+			break loop
+		default:
+			return fail(i, 1, "Unexpected character `%c` in the timestamp", runes[i])
 		}
+	}
 
-		return 60*60*1000*Millis(hh) + 60*1000*Millis(mm) + Millis(ss)*1000 + ms, nil
-	default:
-		return 0, fmt.Errorf("Unexpected amount of components in the timestamp (%d)", len(comps))
+	n := len(comps)
+	if n >= 2 {
+		if comps[n-2] >= 60 {
+			return fail(begins[n-2], begins[n-1]-1-begins[n-2], "Minutes must be less than 60 but got %d", comps[n-2])
+		}
+		if comps[n-1] >= 60 {
+			width := 0
+			for begins[n-1]+width < len(runes) && IsDigit(runes[begins[n-1]+width]) {
+				width += 1
+			}
+			return fail(begins[n-1], width, "Seconds must be less than 60 but got %d", comps[n-1])
+		}
 	}
+
+	var hh, mm, ss int64 = 0, 0, 0
+	switch n {
+	case 3:
+		hh, mm, ss = comps[0], comps[1], comps[2]
+	case 2:
+		mm, ss = comps[0], comps[1]
+	case 1:
+		ss = comps[0]
+	}
+	return 60*60*1000*Millis(hh) + 60*1000*Millis(mm) + Millis(ss)*1000 + ms, nil
 }
 
 type Loc struct {
@@ -83,10 +237,42 @@ type Loc struct {
 type DiagErr struct {
 	Loc Loc
 	Err error
+	// Optional excerpt of the source line the error is located on. The Len
+	// runes starting from Loc.Col are underlined with carets.
+	Line string
+	Len  int
 }
 
 func (err *DiagErr) Error() string {
-	return fmt.Sprintf("%s: ERROR: %s", err.Loc, err.Err)
+	sb := strings.Builder{}
+	fmt.Fprintf(&sb, "%s: ERROR: %s", err.Loc, err.Err)
+	if len(err.Line) > 0 {
+		sb.WriteString(sourceExcerpt(err.Line, err.Loc.Col, err.Len))
+	}
+	return sb.String()
+}
+
+// Renders the line with the n runes starting from the col underlined with
+// carets
+func sourceExcerpt(line string, col int, n int) string {
+	sb := strings.Builder{}
+	sb.WriteString("\n    ")
+	sb.WriteString(line)
+	sb.WriteString("\n    ")
+	for i, ch := range []rune(line) {
+		if i >= col {
+			break
+		}
+		// Keeping the tabs so the carets are aligned with the line above
+		if ch == '\t' {
+			sb.WriteRune('\t')
+		} else {
+			sb.WriteRune(' ')
+		}
+	}
+	sb.WriteString("^")
+	sb.WriteString(strings.Repeat("~", max(n-1, 0)))
+	return sb.String()
 }
 
 func (loc Loc) String() string {
@@ -101,6 +287,9 @@ type Lexer struct {
 	Bol      int
 	PeekBuf  Token
 	PeekFull bool
+	// Emit comments as TokenComment instead of skipping them. Used by the
+	// tools that need to preserve the comments like `markut fmt`.
+	KeepComments bool
 }
 
 func NewLexer(content string, filePath string) Lexer {
@@ -127,6 +316,13 @@ const (
 	TokenTimestamp
 	TokenDash
 	TokenPlus
+	TokenBlock
+	TokenList
+	TokenNumber
+	TokenBool
+	TokenSlash
+	TokenFrames
+	TokenComment
 )
 
 var TokenKindName = map[TokenKind]string{
@@ -144,6 +340,13 @@ var TokenKindName = map[TokenKind]string{
 	TokenTimestamp:    "timestamp",
 	TokenDash:         "dash",
 	TokenPlus:         "plus",
+	TokenBlock:        "block",
+	TokenList:         "list",
+	TokenNumber:       "number",
+	TokenBool:         "bool",
+	TokenSlash:        "slash",
+	TokenFrames:       "frames",
+	TokenComment:      "comment",
 }
 
 type LiteralToken struct {
@@ -160,6 +363,7 @@ var LiteralTokens = []LiteralToken{
 	{Text: ")", Kind: TokenParenClose},
 	{Text: "...", Kind: TokenEllipsis},
 	{Text: "*", Kind: TokenAsterisk},
+	{Text: "/", Kind: TokenSlash},
 	{Text: "-", Kind: TokenDash},
 	{Text: "+", Kind: TokenPlus},
 }
@@ -168,7 +372,15 @@ type Token struct {
 	Kind   TokenKind
 	Text   []rune
 	Timestamp Millis
+	Block  []Node
+	List   []Token
+	Number float64
+	Bool   bool
+	Frames int64
 	Loc    Loc
+	// Placeholder for the result of a failed command. Lets the evaluation
+	// keep going after an error without reporting its consequences.
+	Poisoned bool
 }
 
 func (lexer *Lexer) ChopChar() {
@@ -199,6 +411,12 @@ func (lexer *Lexer) DropLine() {
 	}
 }
 
+func (lexer *Lexer) SkipUntilSpace() {
+	for lexer.Cur < len(lexer.Content) && !unicode.IsSpace(lexer.Content[lexer.Cur]) {
+		lexer.ChopChar()
+	}
+}
+
 func (lexer *Lexer) TrimLeft() {
 	for lexer.Cur < len(lexer.Content) && unicode.IsSpace(lexer.Content[lexer.Cur]) {
 		lexer.ChopChar()
@@ -225,13 +443,45 @@ func (lexer *Lexer) Loc() Loc {
 	}
 }
 
+// Creates a DiagErr that points at n runes starting from the position cur in
+// the Content and includes the excerpt of the line they are located on.
+func (lexer *Lexer) DiagErrAt(cur int, n int, err error) *DiagErr {
+	cur = min(cur, len(lexer.Content))
+	row := lexer.Row
+	bol := lexer.Bol
+	for bol > cur {
+		row -= 1
+		bol -= 1
+		for bol > 0 && lexer.Content[bol-1] != '\n' {
+			bol -= 1
+		}
+	}
+	for i := bol; i < cur; i += 1 {
+		if lexer.Content[i] == '\n' {
+			row += 1
+			bol = i + 1
+		}
+	}
+	eol := bol
+	for eol < len(lexer.Content) && lexer.Content[eol] != '\n' {
+		eol += 1
+	}
+	return &DiagErr{
+		Loc: Loc{
+			FilePath: lexer.FilePath,
+			Row:      row,
+			Col:      cur - bol,
+		},
+		Err:  err,
+		Line: string(lexer.Content[bol:eol]),
+		Len:  max(n, 1),
+	}
+}
+
 func (lexer *Lexer) ChopHexByteValue() (result rune, err error) {
 	for i := 0; i < 2; i += 1 {
 		if lexer.Cur >= len(lexer.Content) {
-			err = &DiagErr{
-				Loc: lexer.Loc(),
-				Err: fmt.Errorf("Unfinished hexadecimal value of a byte. Expected 2 hex digits, but got %d.", i),
-			}
+			err = lexer.DiagErrAt(lexer.Cur, 1, fmt.Errorf("Unfinished hexadecimal value of a byte. Expected 2 hex digits, but got %d.", i))
 			return
 		}
 		x := lexer.Content[lexer.Cur]
@@ -242,10 +492,7 @@ func (lexer *Lexer) ChopHexByteValue() (result rune, err error) {
 		} else if 'A' <= x && x <= 'F' {
 			result = result*0x10 + x - 'A' + 10
 		} else {
-			err = &DiagErr{
-				Loc: lexer.Loc(),
-				Err: fmt.Errorf("Expected hex digit, but got `%c`", x),
-			}
+			err = lexer.DiagErrAt(lexer.Cur, 1, fmt.Errorf("Expected hex digit, but got `%c`", x))
 			return
 		}
 		lexer.ChopChar()
@@ -267,10 +514,7 @@ loop:
 		if lexer.Content[lexer.Cur] == '\\' {
 			lexer.ChopChar()
 			if lexer.Cur >= len(lexer.Content) {
-				err = &DiagErr{
-					Loc: lexer.Loc(),
-					Err: fmt.Errorf("Unfinished escape sequence"),
-				}
+				err = lexer.DiagErrAt(lexer.Cur, 1, fmt.Errorf("Unfinished escape sequence"))
 				return
 			}
 
@@ -300,10 +544,7 @@ loop:
 					lit = append(lit, quote)
 					lexer.ChopChar()
 				} else {
-					err = &DiagErr{
-						Loc: lexer.Loc(),
-						Err: fmt.Errorf("Unknown escape sequence starting with %c", lexer.Content[lexer.Cur]),
-					}
+					err = lexer.DiagErrAt(lexer.Cur, 1, fmt.Errorf("Unknown escape sequence starting with %c", lexer.Content[lexer.Cur]))
 					return
 				}
 			}
@@ -317,14 +558,7 @@ loop:
 	}
 
 	if lexer.Cur >= len(lexer.Content) || lexer.Content[lexer.Cur] != quote {
-		err = &DiagErr{
-			Loc: Loc{
-				FilePath: lexer.FilePath,
-				Row:      lexer.Row,
-				Col:      begin,
-			},
-			Err: fmt.Errorf("Expected '%c' at the end of this string literal", quote),
-		}
+		err = lexer.DiagErrAt(begin-1, 1, fmt.Errorf("Expected '%c' at the end of this string literal", quote))
 		return
 	}
 	lexer.ChopChar()
@@ -340,6 +574,28 @@ func IsSymbol(ch rune) bool {
 	return unicode.IsLetter(ch) || unicode.IsNumber(ch) || ch == '_'
 }
 
+// Operator symbols like `<`, `>=`, `!=` etc. They are lexed as TokenSymbol
+// and looked up among funcs just like the regular symbols.
+func IsOperator(ch rune) bool {
+	return ch == '<' || ch == '>' || ch == '=' || ch == '!'
+}
+
+func IsValidSymbol(name []rune) bool {
+	if len(name) == 0 || !IsSymbolStart(name[0]) {
+		return false
+	}
+	for _, ch := range name[1:] {
+		if !IsSymbol(ch) {
+			return false
+		}
+	}
+	return true
+}
+
+func IsNumber(ch rune) bool {
+	return unicode.IsNumber(ch) || ch == '.'
+}
+
 func IsTimestamp(ch rune) bool {
 	return unicode.IsNumber(ch) || ch == ':' || ch == '.'
 }
@@ -349,17 +605,35 @@ func (lexer *Lexer) ChopToken() (token Token, err error) {
 		lexer.TrimLeft()
 
 		if lexer.Prefix([]rune("//")) {
+			if lexer.KeepComments {
+				token.Loc = lexer.Loc()
+				begin := lexer.Cur
+				for lexer.Cur < len(lexer.Content) && lexer.Content[lexer.Cur] != '\n' {
+					lexer.ChopChar()
+				}
+				token.Kind = TokenComment
+				token.Text = lexer.Content[begin:lexer.Cur]
+				return
+			}
 			lexer.DropLine()
 			continue
 		}
 
 		if lexer.Prefix([]rune("/*")) {
+			loc := lexer.Loc()
+			begin := lexer.Cur
 			for lexer.Cur < len(lexer.Content) && !lexer.Prefix([]rune("*/")) {
 				lexer.ChopChar()
 			}
 			if lexer.Prefix([]rune("*/")) {
 				lexer.ChopChars(2)
 			}
+			if lexer.KeepComments {
+				token.Loc = loc
+				token.Kind = TokenComment
+				token.Text = lexer.Content[begin:lexer.Cur]
+				return
+			}
 			continue
 		}
 
@@ -380,17 +654,80 @@ func (lexer *Lexer) ChopToken() (token Token, err error) {
 			lexer.ChopChar()
 		}
 
+		if lexer.Cur < len(lexer.Content) && lexer.Content[lexer.Cur] == 'f' && (lexer.Cur+1 >= len(lexer.Content) || !IsSymbol(lexer.Content[lexer.Cur+1])) {
+			for i := begin; i < lexer.Cur; i += 1 {
+				if !IsDigit(lexer.Content[i]) {
+					err = lexer.DiagErrAt(i, 1, fmt.Errorf("Invalid frame count: Expected a digit but got `%c`", lexer.Content[i]))
+					return
+				}
+			}
+			if lexer.Cur-begin > MaxTimestampComponentDigits {
+				err = lexer.DiagErrAt(begin, lexer.Cur-begin, fmt.Errorf("Invalid frame count: the number is too big"))
+				return
+			}
+			token.Kind = TokenFrames
+			token.Frames, _ = strconv.ParseInt(string(lexer.Content[begin:lexer.Cur]), 10, 64)
+			lexer.ChopChar()
+			token.Text = lexer.Content[begin:lexer.Cur]
+			return
+		}
+
+		if lexer.Cur < len(lexer.Content) && unicode.IsLetter(lexer.Content[lexer.Cur]) {
+			for lexer.Cur < len(lexer.Content) && IsSymbol(lexer.Content[lexer.Cur]) {
+				lexer.ChopChar()
+			}
+			token.Text = lexer.Content[begin:lexer.Cur]
+			token.Timestamp, err = durationToMillis(string(token.Text))
+			if err != nil {
+				var tsErr *TimestampErr
+				if errors.As(err, &tsErr) {
+					err = lexer.DiagErrAt(begin+tsErr.Offset, tsErr.Len, fmt.Errorf("Invalid duration: %w", tsErr.Err))
+				} else {
+					err = lexer.DiagErrAt(begin, len(token.Text), fmt.Errorf("Invalid duration: %w", err))
+				}
+			}
+			return
+		}
+
 		token.Text = lexer.Content[begin:lexer.Cur]
+		if ms, frames, ok := smpteToMillis(token.Text); ok {
+			token.Kind = TokenFrames
+			token.Timestamp = ms
+			token.Frames = frames
+			return
+		}
 		token.Timestamp, err = tsToMillis(string(token.Text))
 		if err != nil {
-			err = &DiagErr{
-				Loc: token.Loc,
-				Err: fmt.Errorf("Invalid timestamp symbol: %w", err),
+			var tsErr *TimestampErr
+			if errors.As(err, &tsErr) {
+				err = lexer.DiagErrAt(begin+tsErr.Offset, tsErr.Len, fmt.Errorf("Invalid timestamp: %w", tsErr.Err))
+			} else {
+				err = lexer.DiagErrAt(begin, len(token.Text), fmt.Errorf("Invalid timestamp: %w", err))
 			}
 		}
 		return
 	}
 
+	if lexer.Content[lexer.Cur] == '#' {
+		lexer.ChopChar()
+		begin := lexer.Cur
+
+		if lexer.Cur < len(lexer.Content) && lexer.Content[lexer.Cur] == '-' {
+			lexer.ChopChar()
+		}
+		for lexer.Cur < len(lexer.Content) && IsNumber(lexer.Content[lexer.Cur]) {
+			lexer.ChopChar()
+		}
+
+		token.Kind = TokenNumber
+		token.Text = lexer.Content[begin-1:lexer.Cur]
+		token.Number, err = strconv.ParseFloat(string(lexer.Content[begin:lexer.Cur]), 64)
+		if err != nil {
+			err = lexer.DiagErrAt(begin-1, len(token.Text), fmt.Errorf("Invalid number literal %s. Expected something like #2, #-1 or #0.75", string(token.Text)))
+		}
+		return
+	}
+
 	if IsSymbolStart(lexer.Content[lexer.Cur]) {
 		begin := lexer.Cur
 
@@ -403,6 +740,18 @@ func (lexer *Lexer) ChopToken() (token Token, err error) {
 		return
 	}
 
+	if IsOperator(lexer.Content[lexer.Cur]) {
+		begin := lexer.Cur
+
+		for lexer.Cur < len(lexer.Content) && IsOperator(lexer.Content[lexer.Cur]) {
+			lexer.ChopChar()
+		}
+
+		token.Kind = TokenSymbol
+		token.Text = lexer.Content[begin:lexer.Cur]
+		return
+	}
+
 	if lexer.Content[lexer.Cur] == '"' || lexer.Content[lexer.Cur] == '\'' {
 		var lit []rune
 		lit, err = lexer.ChopStrLit()
@@ -424,13 +773,31 @@ func (lexer *Lexer) ChopToken() (token Token, err error) {
 		}
 	}
 
-	err = &DiagErr{
-		Loc: lexer.Loc(),
-		Err: fmt.Errorf("Invalid token"),
-	}
+	err = lexer.DiagErrAt(lexer.Cur, 1, fmt.Errorf("Invalid token"))
 	return
 }
 
+// Token along with the location right after its last character
+type SpannedToken struct {
+	Token Token
+	End   Loc
+}
+
+// Lexes the rest of the content remembering where each token ends
+func (lexer *Lexer) ChopAllTokens() (tokens []SpannedToken, err error) {
+	for {
+		var token Token
+		token, err = lexer.ChopToken()
+		if err != nil || token.Kind == TokenEOF {
+			return
+		}
+		tokens = append(tokens, SpannedToken{
+			Token: token,
+			End:   lexer.Loc(),
+		})
+	}
+}
+
 func (lexer *Lexer) Peek() (token Token, err error) {
 	if !lexer.PeekFull {
 		token, err = lexer.ChopToken()
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestLexerLiterals(t *testing.T) {
+	cases := []struct {
+		input     string
+		kind      TokenKind
+		timestamp Millis
+		frames    int64
+		number    float64
+	}{
+		{input: "5", kind: TokenTimestamp, timestamp: 5 * 1000},
+		{input: "1:30", kind: TokenTimestamp, timestamp: 90 * 1000},
+		{input: "0:00:00.2", kind: TokenTimestamp, timestamp: 200},
+		{input: "01:02:03.456", kind: TokenTimestamp, timestamp: (1*60*60+2*60+3)*1000 + 456},
+		{input: "90s", kind: TokenTimestamp, timestamp: 90 * 1000},
+		{input: "5m30s", kind: TokenTimestamp, timestamp: (5*60 + 30) * 1000},
+		{input: "1h2m", kind: TokenTimestamp, timestamp: (60 + 2) * 60 * 1000},
+		{input: "250ms", kind: TokenTimestamp, timestamp: 250},
+		{input: "1234f", kind: TokenFrames, frames: 1234},
+		{input: "00:01:00:12", kind: TokenFrames, timestamp: 60 * 1000, frames: 12},
+		{input: "#3.25", kind: TokenNumber, number: 3.25},
+		{input: "#-2", kind: TokenNumber, number: -2},
+	}
+	for _, c := range cases {
+		lexer := NewLexer(c.input, "test.markut")
+		token, err := lexer.ChopToken()
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", c.input, err)
+			continue
+		}
+		if token.Kind != c.kind {
+			t.Errorf("%s: expected %s but got %s", c.input, TokenKindName[c.kind], TokenKindName[token.Kind])
+			continue
+		}
+		if token.Timestamp != c.timestamp || token.Frames != c.frames || token.Number != c.number {
+			t.Errorf("%s: expected timestamp %d, frames %d and number %g but got %d, %d and %g", c.input, c.timestamp, c.frames, c.number, token.Timestamp, token.Frames, token.Number)
+		}
+		if rest, _ := lexer.ChopToken(); rest.Kind != TokenEOF {
+			t.Errorf("%s: expected a single token but got %s after it", c.input, TokenKindName[rest.Kind])
+		}
+	}
+}
+
+func TestLexerInvalidLiterals(t *testing.T) {
+	inputs := []string{
+		"1:2:3:4:5",
+		"1..2",
+		"0:61:00",
+		"0:00:01.2345",
+		"5x",
+		"30s5m",
+		"5m5m",
+		"12a4f",
+		"00:61:00:12",
+		"#",
+		"#1.2.3",
+	}
+	for _, input := range inputs {
+		lexer := NewLexer(input, "test.markut")
+		if token, err := lexer.ChopToken(); err == nil {
+			t.Errorf("%s: expected an error but got %s", input, TokenKindName[token.Kind])
+		}
+	}
+}
+
+func TestLexerTimestampErrorLocation(t *testing.T) {
+	cases := []struct {
+		input string
+		col   int
+		len   int
+	}{
+		{input: "1..2", col: 2, len: 1},
+		{input: "0:61:00", col: 2, len: 2},
+		{input: "0:00:01.2345", col: 11, len: 1},
+		{input: "chunk 0:99", col: 8, len: 2},
+	}
+	for _, c := range cases {
+		lexer := NewLexer(c.input, "test.markut")
+		var err error
+		for {
+			var token Token
+			token, err = lexer.ChopToken()
+			if err != nil || token.Kind == TokenEOF {
+				break
+			}
+		}
+		var diagErr *DiagErr
+		if !errors.As(err, &diagErr) {
+			t.Errorf("%s: expected a diagnostic but got %v", c.input, err)
+			continue
+		}
+		if diagErr.Loc.Col != c.col || diagErr.Len != c.len {
+			t.Errorf("%s: expected the error at column %d spanning %d characters but got column %d spanning %d", c.input, c.col, c.len, diagErr.Loc.Col, diagErr.Len)
+		}
+	}
+}
@@ -0,0 +1,600 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Minimal implementation of the Language Server Protocol
+// https://microsoft.github.io/language-server-protocol/ for the MARKUT files.
+//
+// NOTE: LSP counts characters in UTF-16 code units, but Loc.Col counts runes.
+// They only diverge on characters outside of the Basic Multilingual Plane
+// which are pretty rare in MARKUT files, so we just ignore the difference.
+
+type LspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type LspRange struct {
+	Start LspPosition `json:"start"`
+	End   LspPosition `json:"end"`
+}
+
+type LspLocation struct {
+	URI   string   `json:"uri"`
+	Range LspRange `json:"range"`
+}
+
+const (
+	LspSeverityError       = 1
+	LspSeverityWarning     = 2
+	LspSeverityInformation = 3
+)
+
+type LspDiagnostic struct {
+	Range              LspRange                `json:"range"`
+	Severity           int                     `json:"severity"`
+	Source             string                  `json:"source"`
+	Message            string                  `json:"message"`
+	RelatedInformation []LspRelatedInformation `json:"relatedInformation,omitempty"`
+}
+
+type LspRelatedInformation struct {
+	Location LspLocation `json:"location"`
+	Message  string      `json:"message"`
+}
+
+type LspRequest struct {
+	ID     *json.RawMessage `json:"id,omitempty"`
+	Method string           `json:"method"`
+	Params json.RawMessage  `json:"params,omitempty"`
+}
+
+type LspResponseError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type LspResponse struct {
+	JSONRPC string            `json:"jsonrpc"`
+	ID      *json.RawMessage  `json:"id"`
+	Result  any               `json:"result"`
+	Error   *LspResponseError `json:"error,omitempty"`
+}
+
+type LspNotification struct {
+	JSONRPC string `json:"jsonrpc"`
+	Method  string `json:"method"`
+	Params  any    `json:"params"`
+}
+
+type LspTextDocumentPositionParams struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	Position LspPosition `json:"position"`
+}
+
+type LspDocument struct {
+	URI  string
+	Path string
+	Text string
+	// The context of the last evaluation of the document. Used for looking up
+	// the user defined words and variables.
+	Context EvalContext
+	// URIs of the files we published the diagnostics for during the last
+	// evaluation. Needed to clear them out on the next one.
+	Published []string
+}
+
+type LspServer struct {
+	in        *bufio.Reader
+	out       io.Writer
+	documents map[string]*LspDocument
+	shutdown  bool
+}
+
+func lspUriToPath(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return uri
+	}
+	return u.Path
+}
+
+func lspPathToUri(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return (&url.URL{Scheme: "file", Path: path}).String()
+}
+
+func (server *LspServer) readMessage() (request LspRequest, err error) {
+	contentLength := -1
+	for {
+		var line string
+		line, err = server.in.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		name, value, found := strings.Cut(line, ":")
+		if found && strings.EqualFold(strings.TrimSpace(name), "Content-Length") {
+			contentLength, err = strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				return
+			}
+		}
+	}
+	if contentLength < 0 {
+		err = fmt.Errorf("message without Content-Length header")
+		return
+	}
+	body := make([]byte, contentLength)
+	_, err = io.ReadFull(server.in, body)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(body, &request)
+	return
+}
+
+func (server *LspServer) writeMessage(message any) {
+	body, err := json.Marshal(message)
+	if err != nil {
+		Diags.Error(Loc{}, "could not serialize LSP message: %s", err)
+		return
+	}
+	fmt.Fprintf(server.out, "Content-Length: %d\r\n\r\n%s", len(body), body)
+}
+
+func (server *LspServer) respond(id *json.RawMessage, result any) {
+	server.writeMessage(LspResponse{
+		JSONRPC: "2.0",
+		ID:      id,
+		Result:  result,
+	})
+}
+
+func (server *LspServer) respondError(id *json.RawMessage, code int, message string) {
+	server.writeMessage(LspResponse{
+		JSONRPC: "2.0",
+		ID:      id,
+		Error: &LspResponseError{
+			Code:    code,
+			Message: message,
+		},
+	})
+}
+
+func (server *LspServer) notify(method string, params any) {
+	server.writeMessage(LspNotification{
+		JSONRPC: "2.0",
+		Method:  method,
+		Params:  params,
+	})
+}
+
+// Collects the diagnostics reported by eval instead of printing them
+func lspCollectDiags(eval func()) (diags []Diag) {
+	Diags.Flush()
+	sink := Diags.Sink
+	Diags.Sink = func(diag Diag) {
+		diags = append(diags, diag)
+	}
+	eval()
+	Diags.Flush()
+	Diags.Sink = sink
+	return
+}
+
+// Range that spans from the loc up until the next whitespace of the text
+func lspRangeOfLoc(text string, loc Loc) LspRange {
+	lines := strings.Split(text, "\n")
+	end := loc.Col + 1
+	if loc.Row < len(lines) {
+		line := []rune(lines[loc.Row])
+		end = loc.Col
+		for end < len(line) && line[end] != ' ' && line[end] != '\t' && line[end] != '\r' {
+			end += 1
+		}
+		end = max(end, loc.Col+1)
+	}
+	return LspRange{
+		Start: LspPosition{Line: loc.Row, Character: loc.Col},
+		End:   LspPosition{Line: loc.Row, Character: end},
+	}
+}
+
+func (server *LspServer) evalDocument(document *LspDocument) {
+	var context EvalContext
+	diags := lspCollectDiags(func() {
+		// The paths in MARKUT files are relative to the folder markut is
+		// usually run from, which is the folder of the MARKUT file.
+		context = EvalContext{
+			outputPath:   "output.mp4",
+			baseDir:      filepath.Dir(document.Path),
+			skipChatLogs: true,
+		}
+		context.evalConfig()
+		context.evalMarkutContent(document.Text, document.Path)
+		context.finishEval()
+	})
+	document.Context = context
+
+	diagnostics := map[string][]LspDiagnostic{}
+	texts := map[string]string{}
+	locationOf := func(loc Loc, n int) (string, LspRange) {
+		path := loc.FilePath
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(document.Path), path)
+		}
+		uri := lspPathToUri(path)
+		if _, ok := texts[uri]; !ok {
+			if uri == document.URI {
+				texts[uri] = document.Text
+			} else if other, ok := server.documents[uri]; ok {
+				texts[uri] = other.Text
+			} else {
+				content, _ := os.ReadFile(path)
+				texts[uri] = string(content)
+			}
+		}
+		rng := lspRangeOfLoc(texts[uri], loc)
+		if n > 0 {
+			rng.End.Character = loc.Col + n
+		}
+		return uri, rng
+	}
+	for _, diag := range diags {
+		if !diag.HasLoc() {
+			continue
+		}
+		severity := LspSeverityInformation
+		switch diag.Severity {
+		case SeverityError, SeverityTodo:
+			severity = LspSeverityError
+		case SeverityWarning:
+			severity = LspSeverityWarning
+		}
+		uri, rng := locationOf(diag.Loc, diag.Len)
+		diagnostic := LspDiagnostic{
+			Range:    rng,
+			Severity: severity,
+			Source:   "markut",
+			Message:  diag.Message,
+		}
+		for _, note := range diag.Notes {
+			if !note.HasLoc() {
+				diagnostic.Message += "\n" + note.Message
+				continue
+			}
+			noteUri, noteRange := locationOf(note.Loc, note.Len)
+			diagnostic.RelatedInformation = append(diagnostic.RelatedInformation, LspRelatedInformation{
+				Location: LspLocation{URI: noteUri, Range: noteRange},
+				Message:  note.Message,
+			})
+		}
+		diagnostics[uri] = append(diagnostics[uri], diagnostic)
+	}
+
+	published := []string{document.URI}
+	for uri := range diagnostics {
+		if uri != document.URI {
+			published = append(published, uri)
+		}
+	}
+	for _, uri := range document.Published {
+		if _, ok := diagnostics[uri]; !ok && uri != document.URI {
+			server.publishDiagnostics(uri, nil)
+		}
+	}
+	for _, uri := range published {
+		server.publishDiagnostics(uri, diagnostics[uri])
+	}
+	document.Published = published
+}
+
+func (server *LspServer) publishDiagnostics(uri string, diagnostics []LspDiagnostic) {
+	if diagnostics == nil {
+		diagnostics = []LspDiagnostic{}
+	}
+	server.notify("textDocument/publishDiagnostics", map[string]any{
+		"uri":         uri,
+		"diagnostics": diagnostics,
+	})
+}
+
+// Lexes the whole document remembering where each token ends. Stops at the
+// first lexing error.
+func lspTokens(text string, path string) []SpannedToken {
+	lexer := NewLexer(text, path)
+	tokens, _ := lexer.ChopAllTokens()
+	return tokens
+}
+
+func lspTokenIndexAt(tokens []SpannedToken, position LspPosition) int {
+	for i, token := range tokens {
+		begin := token.Token.Loc
+		end := token.End
+		afterBegin := begin.Row < position.Line || (begin.Row == position.Line && begin.Col <= position.Character)
+		beforeEnd := position.Line < end.Row || (position.Line == end.Row && position.Character < end.Col)
+		if afterBegin && beforeEnd {
+			return i
+		}
+	}
+	return -1
+}
+
+func lspFuncDocs(name string, f Func) string {
+	return fmt.Sprintf("```\n%s : %s\n```\n%s", name, f.Signature, strings.ReplaceAll(f.Description, "$SPOILER$", ""))
+}
+
+func (server *LspServer) hover(params LspTextDocumentPositionParams) any {
+	document, ok := server.documents[params.TextDocument.URI]
+	if !ok {
+		return nil
+	}
+	tokens := lspTokens(document.Text, document.Path)
+	index := lspTokenIndexAt(tokens, params.Position)
+	if index < 0 || tokens[index].Token.Kind != TokenSymbol {
+		return nil
+	}
+	name := string(tokens[index].Token.Text)
+	var contents string
+	if f, ok := funcs[name]; ok {
+		contents = lspFuncDocs(name, f)
+	} else if word, ok := document.Context.words[name]; ok {
+		contents = fmt.Sprintf("```\n%s\n```\nWord defined at %s", name, word.Loc)
+	} else if variable, ok := document.Context.vars[name]; ok {
+		contents = fmt.Sprintf("```\n%s : %s\n```\nVariable defined at %s", name, TokenKindName[variable.Value.Kind], variable.Loc)
+	} else {
+		return nil
+	}
+	return map[string]any{
+		"contents": map[string]string{
+			"kind":  "markdown",
+			"value": contents,
+		},
+		"range": LspRange{
+			Start: LspPosition{Line: tokens[index].Token.Loc.Row, Character: tokens[index].Token.Loc.Col},
+			End:   LspPosition{Line: tokens[index].End.Row, Character: tokens[index].End.Col},
+		},
+	}
+}
+
+const (
+	LspCompletionItemKindFunction = 3
+	LspCompletionItemKindVariable = 6
+)
+
+func (server *LspServer) completion(params LspTextDocumentPositionParams) any {
+	items := []map[string]any{}
+	names := []string{}
+	for name := range funcs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		items = append(items, map[string]any{
+			"label":  name,
+			"kind":   LspCompletionItemKindFunction,
+			"detail": funcs[name].Signature.String(),
+			"documentation": map[string]string{
+				"kind":  "markdown",
+				"value": strings.ReplaceAll(funcs[name].Description, "$SPOILER$", ""),
+			},
+		})
+	}
+	if document, ok := server.documents[params.TextDocument.URI]; ok {
+		for name, word := range document.Context.words {
+			items = append(items, map[string]any{
+				"label":  name,
+				"kind":   LspCompletionItemKindFunction,
+				"detail": fmt.Sprintf("Word defined at %s", word.Loc),
+			})
+		}
+		for name, variable := range document.Context.vars {
+			items = append(items, map[string]any{
+				"label":  name,
+				"kind":   LspCompletionItemKindVariable,
+				"detail": fmt.Sprintf("%s defined at %s", TokenKindName[variable.Value.Kind], variable.Loc),
+			})
+		}
+	}
+	return items
+}
+
+func lspLocationOf(document *LspDocument, loc Loc) LspLocation {
+	path := loc.FilePath
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(document.Path), path)
+	}
+	return LspLocation{
+		URI: lspPathToUri(path),
+		Range: LspRange{
+			Start: LspPosition{Line: loc.Row, Character: loc.Col},
+			End:   LspPosition{Line: loc.Row, Character: loc.Col},
+		},
+	}
+}
+
+func (server *LspServer) definition(params LspTextDocumentPositionParams) any {
+	document, ok := server.documents[params.TextDocument.URI]
+	if !ok {
+		return nil
+	}
+	tokens := lspTokens(document.Text, document.Path)
+	index := lspTokenIndexAt(tokens, params.Position)
+	if index < 0 {
+		return nil
+	}
+	token := tokens[index].Token
+	switch token.Kind {
+	case TokenString:
+		for _, include := range ParseMarkutContent(document.Text, document.Path).Includes {
+			if include.Loc == token.Loc {
+				return lspLocationOf(document, Loc{FilePath: resolveIncludePath(document.Path, document.Context.includePath, include.Path)})
+			}
+		}
+	case TokenSymbol:
+		name := string(token.Text)
+		if word, ok := document.Context.words[name]; ok {
+			return lspLocationOf(document, word.Loc)
+		}
+		if variable, ok := document.Context.vars[name]; ok {
+			return lspLocationOf(document, variable.Loc)
+		}
+	}
+	return nil
+}
+
+// Returns false when the server should stop
+func (server *LspServer) handle(request LspRequest) bool {
+	switch request.Method {
+	case "initialize":
+		server.respond(request.ID, map[string]any{
+			"capabilities": map[string]any{
+				"textDocumentSync": map[string]any{
+					"openClose": true,
+					"change":    1, // Full
+					"save":      true,
+				},
+				"hoverProvider":      true,
+				"completionProvider": map[string]any{},
+				"definitionProvider": true,
+			},
+			"serverInfo": map[string]string{
+				"name": "markut",
+			},
+		})
+	case "initialized":
+	case "shutdown":
+		server.shutdown = true
+		server.respond(request.ID, nil)
+	case "exit":
+		return false
+	case "textDocument/didOpen":
+		var params struct {
+			TextDocument struct {
+				URI  string `json:"uri"`
+				Text string `json:"text"`
+			} `json:"textDocument"`
+		}
+		if json.Unmarshal(request.Params, &params) != nil {
+			return true
+		}
+		document := &LspDocument{
+			URI:  params.TextDocument.URI,
+			Path: lspUriToPath(params.TextDocument.URI),
+			Text: params.TextDocument.Text,
+		}
+		server.documents[document.URI] = document
+		server.evalDocument(document)
+	case "textDocument/didChange":
+		var params struct {
+			TextDocument struct {
+				URI string `json:"uri"`
+			} `json:"textDocument"`
+			ContentChanges []struct {
+				Text string `json:"text"`
+			} `json:"contentChanges"`
+		}
+		if json.Unmarshal(request.Params, &params) != nil {
+			return true
+		}
+		document, ok := server.documents[params.TextDocument.URI]
+		if !ok || len(params.ContentChanges) == 0 {
+			return true
+		}
+		document.Text = params.ContentChanges[len(params.ContentChanges)-1].Text
+		server.evalDocument(document)
+	case "textDocument/didSave":
+		// Other documents may include the saved one
+		for _, document := range server.documents {
+			server.evalDocument(document)
+		}
+	case "textDocument/didClose":
+		var params struct {
+			TextDocument struct {
+				URI string `json:"uri"`
+			} `json:"textDocument"`
+		}
+		if json.Unmarshal(request.Params, &params) != nil {
+			return true
+		}
+		if document, ok := server.documents[params.TextDocument.URI]; ok {
+			for _, uri := range document.Published {
+				server.publishDiagnostics(uri, nil)
+			}
+			delete(server.documents, params.TextDocument.URI)
+		}
+	case "textDocument/hover", "textDocument/completion", "textDocument/definition":
+		var params LspTextDocumentPositionParams
+		if err := json.Unmarshal(request.Params, &params); err != nil {
+			server.respondError(request.ID, -32602, err.Error())
+			return true
+		}
+		switch request.Method {
+		case "textDocument/hover":
+			server.respond(request.ID, server.hover(params))
+		case "textDocument/completion":
+			server.respond(request.ID, server.completion(params))
+		case "textDocument/definition":
+			server.respond(request.ID, server.definition(params))
+		}
+	default:
+		// Notifications without a handler are just ignored according to the spec
+		if request.ID != nil {
+			server.respondError(request.ID, -32601, fmt.Sprintf("Method %s is not supported", request.Method))
+		}
+	}
+	return true
+}
+
+func lspSubcommand(name string, args []string) bool {
+	subFlag := flag.NewFlagSet(name, flag.ContinueOnError)
+
+	err := parseSubcommandFlags(subFlag, args)
+	if err == flag.ErrHelp {
+		return true
+	}
+
+	if err != nil {
+		Diags.Error(Loc{}, "Could not parse command line arguments: %s", err)
+		return false
+	}
+
+	server := LspServer{
+		in:        bufio.NewReader(os.Stdin),
+		out:       os.Stdout,
+		documents: map[string]*LspDocument{},
+	}
+	for {
+		request, err := server.readMessage()
+		if err != nil {
+			if err == io.EOF {
+				return server.shutdown
+			}
+			Diags.Error(Loc{}, "could not read LSP message: %s", err)
+			return false
+		}
+		if !server.handle(request) {
+			return server.shutdown
+		}
+	}
+}
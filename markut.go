@@ -6,10 +6,12 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
 	"regexp"
 	"slices"
 	"sort"
@@ -50,6 +52,82 @@ func millisToSubRipTs(millis Millis) string {
 	return fmt.Sprintf("%s%02d:%02d:%02d,%03d", sign, hh, mm, ss, ms)
 }
 
+// Human readable representation of a value used by `to_string` and `format`
+func tokenToString(token Token) string {
+	switch token.Kind {
+	case TokenTimestamp:
+		return millisToTs(token.Timestamp)
+	case TokenNumber:
+		return strconv.FormatFloat(token.Number, 'f', -1, 64)
+	case TokenBool:
+		return strconv.FormatBool(token.Bool)
+	default:
+		return string(token.Text)
+	}
+}
+
+var FormatSpecRegexp = regexp.MustCompile(`^%[-+# 0]*[0-9]*(\.[0-9]+)?`)
+
+// printf-style formatting of the MARKUT values. Supports %s and %v for any
+// value (timestamps are rendered as HH:MM:SS.mmm), %d for numbers and
+// timestamps in milliseconds, %f, %e and %g for numbers and %% for the
+// percent sign. The flags, width and precision are the same as in Go.
+func formatTokens(template string, values []Token) (string, error) {
+	sb := strings.Builder{}
+	next := 0
+	for len(template) > 0 {
+		i := strings.IndexByte(template, '%')
+		if i < 0 {
+			sb.WriteString(template)
+			break
+		}
+		sb.WriteString(template[:i])
+		template = template[i:]
+		spec := FormatSpecRegexp.FindString(template)
+		if len(spec) >= len(template) {
+			return "", fmt.Errorf("unfinished format verb %s at the end of the template", template)
+		}
+		verb := template[len(spec)]
+		template = template[len(spec)+1:]
+		if verb == '%' {
+			sb.WriteByte('%')
+			continue
+		}
+		if next >= len(values) {
+			return "", fmt.Errorf("not enough values for the template. Expected at least %d but got %d", next+1, len(values))
+		}
+		value := values[next]
+		next += 1
+		switch verb {
+		case 's', 'v':
+			fmt.Fprintf(&sb, spec+"s", tokenToString(value))
+		case 'd':
+			switch value.Kind {
+			case TokenNumber:
+				if value.Number != math.Trunc(value.Number) {
+					return "", fmt.Errorf("%%d expects an integer but got %g", value.Number)
+				}
+				fmt.Fprintf(&sb, spec+"d", int64(value.Number))
+			case TokenTimestamp:
+				fmt.Fprintf(&sb, spec+"d", int64(value.Timestamp))
+			default:
+				return "", fmt.Errorf("%%d expects %s or %s but got %s", TokenKindName[TokenNumber], TokenKindName[TokenTimestamp], TokenKindName[value.Kind])
+			}
+		case 'f', 'e', 'g':
+			if value.Kind != TokenNumber {
+				return "", fmt.Errorf("%%%c expects %s but got %s", verb, TokenKindName[TokenNumber], TokenKindName[value.Kind])
+			}
+			fmt.Fprintf(&sb, spec+string(verb), value.Number)
+		default:
+			return "", fmt.Errorf("unknown format verb %%%c", verb)
+		}
+	}
+	if next < len(values) {
+		return "", fmt.Errorf("too many values for the template. Expected %d but got %d", next, len(values))
+	}
+	return sb.String(), nil
+}
+
 type ChatMessage struct {
 	Nickname string
 	Color    string
@@ -68,20 +146,124 @@ type Chunk struct {
 	InputPath     string
 	ChatLog       []ChatMessageGroup
 	Blur          bool
+	BlurRects     []BlurRect
+	Effects       []RangedEffect
+	FadeIn        Fade
+	FadeOut       Fade
+	// Playback speed set by the `speed` func. 0 means the normal speed
+	Speed         float64
 	Unfinished    bool
 	ExtraOutFlags []Token
+	// Set for the chunks that are rendered from the transitions. See
+	// renderChunks()
+	Transition    *ChunkTransition
+}
+
+// Region of the frame in pixels blurred by `blur_rect` or pixelated by
+// `pixelate_rect`
+type BlurRect struct {
+	X, Y, W, H int
+	Pixelate   bool
+}
+
+// Size of the blocks of `pixelate_rect` in pixels
+const PixelateBlockSize = 16
+
+func (rect BlurRect) String() string {
+	kind := "blurrect"
+	if rect.Pixelate {
+		kind = "pixelate"
+	}
+	return fmt.Sprintf("%s%dx%d+%d+%d", kind, rect.W, rect.H, rect.X, rect.Y)
+}
+
+// Blurs only the rect by blurring its cropped copy and putting it on top of
+// the frame. label makes the names of the intermediate streams unique.
+func (rect BlurRect) Filter(label string) string {
+	effect := "boxblur=lr=min(w\\,h)/4:lp=5:cr=min(cw\\,ch)/4:cp=5"
+	if rect.Pixelate {
+		effect = fmt.Sprintf("scale=iw/%d:ih/%d,scale=%d:%d:flags=neighbor", PixelateBlockSize, PixelateBlockSize, rect.W, rect.H)
+	}
+	return fmt.Sprintf("split[%[1]smain][%[1]srect];[%[1]srect]crop=%[2]d:%[3]d:%[4]d:%[5]d,%[6]s[%[1]sblurred];[%[1]smain][%[1]sblurred]overlay=%[4]d:%[5]d", label, rect.W, rect.H, rect.X, rect.Y, effect)
+}
+
+type EffectKind int
+
+const (
+	EffectBlur EffectKind = iota
+	EffectMute
+)
+
+var EffectKindNames = map[EffectKind]string{
+	EffectBlur: "blur",
+	EffectMute: "mute",
+}
+
+// Effect applied only to a part of a chunk. Introduced by the funcs like
+// `blur_range`. Start and End are the timestamps of the input just like the
+// ones of the chunk itself.
+type RangedEffect struct {
+	Loc   Loc
+	Kind  EffectKind
+	Start Millis
+	End   Millis
+}
+
+func (effect RangedEffect) String() string {
+	return fmt.Sprintf("%s%d-%d", EffectKindNames[effect.Kind], effect.Start, effect.End)
+}
+
+// The ffmpeg timeline expression that enables a filter only within the
+// effect. The time of the filters is the time within the rendered chunk, so
+// it depends on where the chunk starts and how fast it is played.
+func (chunk Chunk) effectEnable(effect RangedEffect) string {
+	start := chunk.scaleToOutput(effect.Start - chunk.Start)
+	end := chunk.scaleToOutput(effect.End - chunk.Start)
+	return fmt.Sprintf("enable='between(t,%s,%s)'", millisToSecsForFFmpeg(start), millisToSecsForFFmpeg(end))
+}
+
+// Introduced by the `fade_in` and `fade_out` funcs. The audio is always faded,
+// the video only if Video is set.
+type Fade struct {
+	Duration Millis
+	Video    bool
+}
+
+func (fade Fade) String() string {
+	if fade.Video {
+		return fmt.Sprintf("%dv", fade.Duration)
+	}
+	return fmt.Sprintf("%d", fade.Duration)
 }
 
 const ChunksFolder = "chunks"
 const TwitchChatDownloaderCSVHeader = "time,user_name,user_color,message"
 
 func (chunk Chunk) Name() string {
+	if chunk.Transition != nil {
+		return chunk.Transition.Name()
+	}
 	inputPath := strings.ReplaceAll(chunk.InputPath, "/", "_")
 	sb := strings.Builder{}
 	fmt.Fprintf(&sb, "%s/%s-%09d-%09d", ChunksFolder, inputPath, chunk.Start, chunk.End)
 	if chunk.Blur {
 		sb.WriteString("-blur")
 	}
+	for _, rect := range chunk.BlurRects {
+		fmt.Fprintf(&sb, "-%s", rect)
+	}
+	for _, effect := range chunk.Effects {
+		fmt.Fprintf(&sb, "-%s", effect)
+	}
+	if chunk.FadeIn.Duration > 0 {
+		fmt.Fprintf(&sb, "-fadein%s", chunk.FadeIn)
+	}
+	if chunk.FadeOut.Duration > 0 {
+		fmt.Fprintf(&sb, "-fadeout%s", chunk.FadeOut)
+	}
+	if chunk.SpeedFactor() != 1 {
+		fmt.Fprintf(&sb, "-speed%g", chunk.SpeedFactor())
+	}
 	for _, outFlag := range chunk.ExtraOutFlags {
 		sb.WriteString(strings.ReplaceAll(string(outFlag.Text), "/", "_"))
 	}
@@ -93,6 +275,29 @@ func (chunk Chunk) Duration() Millis {
 	return chunk.End - chunk.Start
 }
 
+func (chunk Chunk) SpeedFactor() float64 {
+	if chunk.Speed == 0 {
+		return 1
+	}
+	return chunk.Speed
+}
+
+// Duration of the chunk in the final video, i.e. with the speed applied
+func (chunk Chunk) OutputDuration() Millis {
+	return chunk.scaleToOutput(chunk.Duration())
+}
+
+// Converts a duration within the input footage of the chunk to the duration
+// in the final video
+func (chunk Chunk) scaleToOutput(millis Millis) Millis {
+	return Millis(math.Round(float64(millis) / chunk.SpeedFactor()))
+}
+
+// The opposite of scaleToOutput
+func (chunk Chunk) scaleToInput(millis Millis) Millis {
+	return Millis(math.Round(float64(millis) * chunk.SpeedFactor()))
+}
+
 func (chunk Chunk) Rendered() (bool, error) {
 	_, err := os.Stat(chunk.Name())
 	if err == nil {
@@ -140,6 +345,249 @@ func (context *EvalContext) typeCheckArgs(loc Loc, signature ...TokenKind) (args
 	return
 }
 
+// Pops the arguments described by the signature from the argsStack. args[0]
+// is the top of the stack.
+func (context *EvalContext) typeCheckSignature(loc Loc, signature Signature) (args []Token, err error) {
+	if len(context.argsStack) < len(signature.Ins) {
+		err = &DiagErr{
+			Loc: loc,
+			Err: fmt.Errorf("Expected %d arguments but got %d", len(signature.Ins), len(context.argsStack)),
+		}
+		return
+	}
+
+	vars := map[string]TokenKind{}
+	for i := len(signature.Ins) - 1; i >= 0; i -= 1 {
+		param := signature.Ins[i]
+		n := len(context.argsStack)
+		arg := context.argsStack[n-1]
+		context.argsStack = context.argsStack[:n-1]
+		args = append(args, arg)
+		if arg.Poisoned {
+			continue
+		}
+		if len(param.Kinds) > 0 && !slices.Contains(param.Kinds, arg.Kind) {
+			err = &DiagErr{
+				Loc: arg.Loc,
+				Err: fmt.Errorf("Expected %s but got %s", kindNamesToString(param.Kinds), TokenKindName[arg.Kind]),
+			}
+			return
+		}
+		if param.Var != "" {
+			if kind, ok := vars[param.Var]; ok && kind != arg.Kind {
+				err = &DiagErr{
+					Loc: arg.Loc,
+					Err: fmt.Errorf("Expected %s but got %s", TokenKindName[kind], TokenKindName[arg.Kind]),
+				}
+				return
+			}
+			vars[param.Var] = arg.Kind
+		}
+	}
+
+	return
+}
+
+func kindNamesToString(kinds []TokenKind) string {
+	names := []string{}
+	for _, kind := range kinds {
+		names = append(names, TokenKindName[kind])
+	}
+	return strings.Join(names, " or ")
+}
+
+func kindsToString(kinds []TokenKind) string {
+	names := []string{}
+	for i := len(kinds) - 1; i >= 0; i -= 1 {
+		names = append(names, "<"+TokenKindName[kinds[i]]+">")
+	}
+	return strings.Join(names, " ")
+}
+
+// Same as typeCheckArgs but accepts several alternative signatures and picks
+// the first one that matches the top of the argsStack. Returns the index of the
+// picked overload.
+func (context *EvalContext) typeCheckOverloads(loc Loc, overloads ...[]TokenKind) (args []Token, overload int, err error) {
+	for i, signature := range overloads {
+		n := len(context.argsStack)
+		if n < len(signature) {
+			continue
+		}
+		matches := true
+		for j, kind := range signature {
+			if context.argsStack[n-1-j].Kind != kind {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			args, err = context.typeCheckArgs(loc, signature...)
+			overload = i
+			return
+		}
+	}
+
+	expected := []string{}
+	arity := 0
+	for _, signature := range overloads {
+		expected = append(expected, kindsToString(signature))
+		arity = max(arity, len(signature))
+	}
+	n := len(context.argsStack)
+	if n < arity {
+		err = &DiagErr{
+			Loc: loc,
+			Err: fmt.Errorf("Expected %d arguments but got %d", arity, n),
+		}
+		return
+	}
+	actual := []TokenKind{}
+	for i := 0; i < arity; i += 1 {
+		actual = append(actual, context.argsStack[n-1-i].Kind)
+	}
+	err = &DiagErr{
+		Loc: context.argsStack[n-1].Loc,
+		Err: fmt.Errorf("Expected %s but got %s", strings.Join(expected, " or "), kindsToString(actual)),
+	}
+	context.argsStack = context.argsStack[:n-arity]
+	return
+}
+
+// Converts frame count and SMPTE timecode literals to timestamps according to
+// the frame rate set by the `fps` func
+func (context *EvalContext) framesToTimestamp(token Token) (timestamp Token, ok bool) {
+	if context.fps <= 0 {
+		Diags.Error(token.Loc, "the frame rate is not set. Use the `fps` func to set it before using frame based timestamps")
+		return
+	}
+	if strings.Contains(string(token.Text), ":") {
+		if float64(token.Frames) >= math.Ceil(context.fps) {
+			Diags.Error(token.Loc, "the frame %d of the SMPTE timecode is out of range for the frame rate %g", token.Frames, context.fps).
+				Note(context.fpsLoc, "the frame rate is set here")
+			return
+		}
+	}
+	timestamp = Token{
+		Kind:      TokenTimestamp,
+		Text:      token.Text,
+		Timestamp: token.Timestamp + Millis(math.Round(float64(token.Frames)*1000/context.fps)),
+		Loc:       token.Loc,
+	}
+	ok = true
+	return
+}
+
+// Implementation of the `let` and `const` funcs
+func (context *EvalContext) bindVariable(args []Token, isConst bool) bool {
+	name := args[0]
+	value := args[1]
+
+	if !IsValidSymbol(name.Text) {
+		Diags.Error(name.Loc, "\"%s\" is not a valid name for a variable", string(name.Text))
+		return false
+	}
+	if _, ok := funcs[string(name.Text)]; ok {
+		Diags.Error(name.Loc, "the name %s is already taken by a builtin func", string(name.Text))
+		return false
+	}
+	if word, ok := context.words[string(name.Text)]; ok {
+		Diags.Error(name.Loc, "the name %s is already taken by a word", string(name.Text)).
+			Note(word.Loc, "the word is defined here")
+		return false
+	}
+	if variable, ok := context.vars[string(name.Text)]; ok {
+		if variable.Const || isConst {
+			Diags.Error(name.Loc, "redefinition of the constant %s", string(name.Text)).
+				Note(variable.Loc, "it is originally defined here")
+			return false
+		}
+	}
+	if context.vars == nil {
+		context.vars = map[string]Variable{}
+	}
+	context.vars[string(name.Text)] = Variable{
+		Loc:   name.Loc,
+		Value: value,
+		Const: isConst,
+	}
+	return true
+}
+
+// Returns a negative number if the first one is less than the second one, a
+// positive number if it's greater and zero if they are equal. The kinds of `a`
+// and `b` are expected to be the same and one of the ComparableKinds.
+func compareValues(a Token, b Token) (cmp int) {
+	switch a.Kind {
+	case TokenTimestamp:
+		cmp = int(max(min(a.Timestamp-b.Timestamp, 1), -1))
+	case TokenString:
+		cmp = strings.Compare(string(a.Text), string(b.Text))
+	case TokenNumber:
+		if a.Number < b.Number {
+			cmp = -1
+		} else if a.Number > b.Number {
+			cmp = 1
+		}
+	case TokenBool:
+		if a.Bool != b.Bool {
+			cmp = 1
+			if !a.Bool {
+				cmp = -1
+			}
+		}
+	}
+	return
+}
+
+// Human readable representation of a value on the argsStack in the syntax of
+// the Markut Language wherever possible
+func displayValue(token Token) string {
+	if token.Poisoned {
+		return "<error>"
+	}
+	switch token.Kind {
+	case TokenTimestamp:
+		return millisToTs(token.Timestamp)
+	case TokenString:
+		return quoteStrLit(token.Text)
+	case TokenNumber:
+		return "#" + strconv.FormatFloat(token.Number, 'f', -1, 64)
+	case TokenBool:
+		return strconv.FormatBool(token.Bool)
+	case TokenList:
+		return displayValues("[", token.List, "]")
+	case TokenBlock:
+		return displayNodes("{", token.Block, "}")
+	default:
+		return string(token.Text)
+	}
+}
+
+func displayValues(open string, tokens []Token, close string) string {
+	parts := []string{open}
+	for _, token := range tokens {
+		parts = append(parts, displayValue(token))
+	}
+	parts = append(parts, close)
+	return strings.Join(parts, " ")
+}
+
+func displayNodes(open string, nodes []Node, close string) string {
+	parts := []string{open}
+	for _, node := range nodes {
+		switch node.Kind {
+		case NodeToken:
+			parts = append(parts, fmtToken(node.Token))
+		case NodeBlock:
+			parts = append(parts, displayNodes("{", node.Children, "}"))
+		case NodeList:
+			parts = append(parts, displayNodes("[", node.Children, "]"))
+		}
+	}
+	parts = append(parts, close)
+	return strings.Join(parts, " ")
+}
+
 type Cut struct {
 	startLoc    Loc
 	startOffset Millis
@@ -150,6 +598,63 @@ type Cut struct {
 	closed      bool
 }
 
+// The part of the final video covered by the cut. startOffset goes back from
+// the end of startChunk and endOffset goes forward from the start of
+// endChunk, both in the final video, so the speed of the chunks and the
+// transitions between them are taken into account. The chunks are the ones of
+// renderChunks() trimmed to the cut. The transitions are never trimmed and
+// are kept whole if the cut touches them.
+func (context EvalContext) cutChunks(cut Cut) []Chunk {
+	// Where the chunks start in the final video
+	starts := []Millis{}
+	var cursor Millis = 0
+	for i, chunk := range context.chunks {
+		starts = append(starts, cursor)
+		cursor += chunk.OutputDuration()
+		if transition := context.transitionAfter(i); transition != nil {
+			cursor -= transition.Duration
+		}
+	}
+	from := Millis(0)
+	if cut.startChunk >= 0 {
+		from = max(starts[cut.startChunk]+context.chunks[cut.startChunk].OutputDuration()-cut.startOffset, 0)
+	}
+	to := cursor
+	if cut.endChunk < len(context.chunks) {
+		to = min(starts[cut.endChunk]+cut.endOffset, cursor)
+	}
+
+	result := []Chunk{}
+	cursor = 0
+	for _, chunk := range context.renderChunks() {
+		start := cursor
+		end := cursor + chunk.OutputDuration()
+		cursor = end
+		if end <= from || to <= start {
+			continue
+		}
+		if chunk.Transition == nil {
+			if start < from {
+				chunk.Start += chunk.scaleToInput(from - start)
+				chunk.FadeIn = Fade{}
+			}
+			if to < end {
+				chunk.End -= chunk.scaleToInput(end - to)
+				chunk.FadeOut = Fade{}
+			}
+			// Whatever is left of the fades must fit into the trimmed chunk
+			if chunk.FadeIn.Duration > chunk.OutputDuration() {
+				chunk.FadeIn = Fade{}
+			}
+			if chunk.FadeOut.Duration > chunk.OutputDuration() {
+				chunk.FadeOut = Fade{}
+			}
+		}
+		result = append(result, chunk)
+	}
+	return result
+}
+
 type EvalContext struct {
 	inputPath     string
 	inputPathLog  []Token
@@ -165,6 +670,10 @@ type EvalContext struct {
 	argsStack     []Token
 	chapStack     []Chapter
 	chapOffset    Millis
+	transitions   []Transition
+
+	// Set by `ffmpeg_prefix`. Takes precedence over the FFMPEG_PREFIX envar
+	ffmpegPrefix  *Token
 
 	VideoCodec    *Token
 	VideoBitrate  *Token
@@ -173,6 +682,32 @@ type EvalContext struct {
 
 	ExtraOutFlags []Token
 	ExtraInFlags  []Token
+
+	fps           float64
+	fpsLoc        Loc
+
+	words         map[string]Word
+	vars          map[string]Variable
+	callDepth     int
+	tracer        *Tracer
+
+	// The folder the relative paths are resolved against instead of the
+	// current working directory. Set by the LSP server.
+	baseDir       string
+	// The LSP server evaluates the file on every change and has no use for
+	// the chat messages
+	skipChatLogs  bool
+
+	// The files that are being evaluated right now, the innermost goes last
+	including     []IncludeFrame
+	// Absolute paths of all the files evaluated so far. Used by `include_once`
+	included      map[string]bool
+	// Folders added by `include_path`
+	includePath   []string
+
+	// Set on the errors that make no sense to recover from, like an infinite
+	// recursion or the user quitting the tracer
+	aborted       bool
 }
 
 const (
@@ -186,22 +721,34 @@ func defaultContext() (EvalContext, bool) {
 	context := EvalContext{
 		outputPath: "output.mp4",
 	}
+	ok := context.evalConfig()
+	return context, ok
+}
 
+// Evaluates $HOME/.markut if it exists
+func (context *EvalContext) evalConfig() bool {
 	if home, ok := os.LookupEnv("HOME"); ok {
 		path := path.Join(home, ".markut")
 		content, err := ioutil.ReadFile(path)
 		if err != nil {
 			if os.IsNotExist(err) {
-				return context, true
+				return true
 			}
-			fmt.Printf("ERROR: Could not open %s to read as a config: %s\n", path, err)
-			return context, false
+			Diags.Error(Loc{}, "Could not open %s to read as a config: %s", path, err)
+			return false
 		}
 		if !context.evalMarkutContent(string(content), path) {
-			return context, false
+			return false
 		}
 	}
-	return context, true
+	return true
+}
+
+func (context EvalContext) resolvePath(path string) string {
+	if context.baseDir == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(context.baseDir, path)
 }
 
 func MaxChunksLocWidthPlusOne(chunks []Chunk) int {
@@ -291,15 +838,20 @@ func (context EvalContext) PrintSummary() error {
 	var finishedLength Millis = 0
 	var renderedLength Millis = 0
 	for i, chunk := range context.chunks {
+		if transition := context.transitionAfter(i); transition != nil {
+			fullLength -= transition.Duration
+		}
 		if i < len(context.chunks)-1 {
-			fmt.Printf("%-*s Cut %2d - %s\n", locWidth, chunk.Loc.String() + ":", i, millisToTs(fullLength+chunk.Duration()))
+			fmt.Printf("%-*s Cut %2d - %s\n", locWidth, chunk.Loc.String() + ":", i, millisToTs(fullLength+chunk.OutputDuration()))
 		}
-		fullLength += chunk.Duration()
+		fullLength += chunk.OutputDuration()
+	}
+	for _, chunk := range context.renderChunks() {
 		if !chunk.Unfinished {
-			finishedLength += chunk.Duration()
+			finishedLength += chunk.OutputDuration()
 		}
 		if _, err := os.Stat(chunk.Name()); err == nil {
-			renderedLength += chunk.Duration()
+			renderedLength += chunk.OutputDuration()
 		}
 	}
 	fmt.Println()
@@ -313,10 +865,34 @@ func (context EvalContext) PrintSummary() error {
 		if rendered {
 			checkMark = "[x]"
 		}
-		fmt.Printf("%-*s %s Chunk %2d - %s -> %s (Duration: %s)\n", locWidth, chunk.Loc.String() + ":", checkMark, index, millisToTs(chunk.Start), millisToTs(chunk.End), millisToTs(chunk.Duration()))
+		speed := ""
+		if chunk.SpeedFactor() != 1 {
+			speed = fmt.Sprintf(", Speed: %gx", chunk.SpeedFactor())
+		}
+		fmt.Printf("%-*s %s Chunk %2d - %s -> %s (Duration: %s%s)\n", locWidth, chunk.Loc.String() + ":", checkMark, index, millisToTs(chunk.Start), millisToTs(chunk.End), millisToTs(chunk.OutputDuration()), speed)
 		// TODO: Print extra output flags of the chunk
 	}
 	fmt.Println()
+	effects := 0
+	for _, chunk := range context.chunks {
+		effects += len(chunk.Effects)
+	}
+	if effects > 0 {
+		fmt.Printf(">>> Effects (%d):\n", effects)
+		for index, chunk := range context.chunks {
+			for _, effect := range chunk.Effects {
+				fmt.Printf("%-*s %s in Chunk %2d - %s -> %s\n", locWidth, effect.Loc.String() + ":", EffectKindNames[effect.Kind], index, millisToTs(effect.Start), millisToTs(effect.End))
+			}
+		}
+		fmt.Println()
+	}
+	if len(context.transitions) > 0 {
+		fmt.Printf(">>> Transitions (%d):\n", len(context.transitions))
+		for _, transition := range context.transitions {
+			fmt.Printf("%-*s %s between Chunk %2d and Chunk %2d (Duration: %s)\n", locWidth, transition.Loc.String() + ":", TransitionKindNames[transition.Kind], transition.After, transition.After+1, millisToTs(transition.Duration))
+		}
+		fmt.Println()
+	}
 	fmt.Printf(">>> YouTube Chapters (%d):\n", len(context.chapters))
 	locWidth = MaxChaptersLocWidthPlusOne(context.chapters)
 	for _, chapter := range context.chapters {
@@ -336,6 +912,11 @@ func (context EvalContext) containsChunkWithName(filePath string) bool {
 			return true
 		}
 	}
+	for _, chunk := range context.renderChunks() {
+		if chunk.Name() == filePath {
+			return true
+		}
+	}
 	return false
 }
 
@@ -370,11 +951,86 @@ func compressChatLog(chatLog []ChatMessageGroup) []ChatMessageGroup {
 	return result
 }
 
+// User-defined word introduced by the `define` func
+type Word struct {
+	Loc  Loc
+	Body []Node
+}
+
+// Named value introduced by the `let` or `const` funcs
+type Variable struct {
+	Loc   Loc
+	Value Token
+	Const bool
+}
+
+// A single input or output of a func. An empty Kinds accepts the values of
+// any kind. All the params of a signature with the same non-empty Var must
+// have the same kind.
+type Param struct {
+	Name  string
+	Kinds []TokenKind
+	Var   string
+}
+
+func param(name string, kinds ...TokenKind) Param {
+	return Param{Name: name, Kinds: kinds}
+}
+
+func typeVar(name string, v string, kinds ...TokenKind) Param {
+	return Param{Name: name, Kinds: kinds, Var: v}
+}
+
+// Ins and Outs are listed from the bottom of the stack to the top
+type Signature struct {
+	Ins  []Param
+	Outs []Param
+}
+
+var TypeNames = map[TokenKind]string{
+	TokenString:    "String",
+	TokenTimestamp: "Timestamp",
+	TokenBlock:     "Block",
+	TokenList:      "List",
+	TokenNumber:    "Number",
+	TokenBool:      "Bool",
+}
+
+var ComparableKinds = []TokenKind{TokenTimestamp, TokenString, TokenNumber, TokenBool}
+
+func (param Param) String() string {
+	typ := param.Var
+	if len(param.Kinds) > 0 {
+		names := []string{}
+		for _, kind := range param.Kinds {
+			names = append(names, TypeNames[kind])
+		}
+		typ = strings.Join(names, "|")
+	}
+	return "<" + param.Name + ":" + typ + ">"
+}
+
+// Renders the signature in the `<start:Timestamp> <end:Timestamp> --` format
+func (signature Signature) String() string {
+	parts := []string{}
+	for _, param := range signature.Ins {
+		parts = append(parts, param.String())
+	}
+	parts = append(parts, "--")
+	for _, param := range signature.Outs {
+		parts = append(parts, param.String())
+	}
+	return strings.Join(parts, " ")
+}
+
 type Func struct {
 	Description string
-	Signature   string
+	Signature   Signature
 	Category    string
-	Run         func(context *EvalContext, command string, token Token) bool
+	// The arguments are checked against the Signature and popped from the
+	// stack by the evaluator before calling Run. args[0] is the top of the
+	// stack.
+	Run func(context *EvalContext, command string, token Token, args []Token) bool
 }
 
 var funcs map[string]Func
@@ -434,88 +1090,438 @@ func loadTwitchChatDownloaderCSVButParseManually(path string) ([]ChatMessageGrou
 	return compressChatLog(chatLog), nil
 }
 
-func (context *EvalContext) evalMarkutContent(content string, path string) bool {
-	lexer := NewLexer(content, path)
-	token := Token{}
-	var err error
-	for {
-		token, err = lexer.Next()
-		if err != nil {
-			fmt.Printf("%s\n", err)
-			return false
-		}
-
-		if token.Kind == TokenEOF {
-			break
-		}
+// Maximum depth of nested user-defined word and block calls. Protects us from
+// blowing up the Go stack on an infinitely recursive word.
+const MaxCallDepth = 1000
 
-		var args []Token
-		switch token.Kind {
-		case TokenDash:
-			args, err = context.typeCheckArgs(token.Loc, TokenTimestamp, TokenTimestamp)
-			if err != nil {
-				fmt.Printf("%s: ERROR: type check failed for subtraction\n", token.Loc)
-				fmt.Printf("%s\n", err)
-				return false
-			}
-			context.argsStack = append(context.argsStack, Token{
-				Loc:       token.Loc,
-				Kind:      TokenTimestamp,
-				Timestamp: args[1].Timestamp - args[0].Timestamp,
-			})
-		case TokenPlus:
-			args, err = context.typeCheckArgs(token.Loc, TokenTimestamp, TokenTimestamp)
-			if err != nil {
-				fmt.Printf("%s: ERROR: type check failed for addition\n", token.Loc)
-				fmt.Printf("%s\n", err)
-				return false
-			}
-			context.argsStack = append(context.argsStack, Token{
-				Loc:       token.Loc,
-				Kind:      TokenTimestamp,
-				Timestamp: args[1].Timestamp + args[0].Timestamp,
-			})
-		case TokenString:
-			fallthrough
-		case TokenTimestamp:
-			context.argsStack = append(context.argsStack, token)
-		case TokenSymbol:
-			command := string(token.Text)
-			f, ok := funcs[command]
-			if !ok {
-				fmt.Printf("%s: ERROR: Unknown command %s\n", token.Loc, command)
-				return false
-			}
-			if !f.Run(context, command, token) {
-				return false
-			}
-		default:
-			fmt.Printf("%s: ERROR: Unexpected token %s\n", token.Loc, TokenKindName[token.Kind])
-			return false
-		}
+func (context *EvalContext) callBlock(loc Loc, body []Node) bool {
+	if context.callDepth >= MaxCallDepth {
+		Diags.Error(loc, "exceeded maximum depth of nested calls %d. Is there an infinite recursion?", MaxCallDepth)
+		context.aborted = true
+		return false
 	}
+	context.callDepth += 1
+	ok := context.evalNodes(body)
+	context.callDepth -= 1
+	return ok
+}
 
+func (context *EvalContext) callWord(command string, word Word, token Token) bool {
+	if !context.callBlock(token.Loc, word.Body) {
+		Diags.Note(token.Loc, "in the expansion of word %s", command)
+		return false
+	}
 	return true
 }
 
-func (context *EvalContext) evalMarkutFile(loc *Loc, path string, ignoreIfMissing bool) bool {
-	content, err := ioutil.ReadFile(path)
-	if err != nil {
-		sb := strings.Builder{}
-		if loc != nil {
-			sb.WriteString(fmt.Sprintf("%s: ", *loc))
-		}
-		if ignoreIfMissing {
-			sb.WriteString("WARNING: ")
-		} else {
-			sb.WriteString("ERROR: ")
+// Collects everything that was pushed onto the argsStack since the stack had
+// the size `depth` into a list.
+func (context *EvalContext) collectList(loc Loc, depth int) (list Token, err error) {
+	if len(context.argsStack) < depth {
+		err = &DiagErr{
+			Loc: loc,
+			Err: fmt.Errorf("the list consumed %d values from the stack that were pushed before it was opened", depth-len(context.argsStack)),
 		}
-		sb.WriteString(fmt.Sprintf("%s", err))
-		fmt.Fprintf(os.Stderr, "%s\n", sb.String())
-		return ignoreIfMissing
+		return
 	}
-
-	return context.evalMarkutContent(string(content), path)
+	list = Token{
+		Kind: TokenList,
+		Text: []rune("["),
+		List: slices.Clone(context.argsStack[depth:]),
+		Loc:  loc,
+	}
+	context.argsStack = context.argsStack[:depth]
+	return
+}
+
+var ArithmeticNames = map[TokenKind]string{
+	TokenDash:     "subtraction",
+	TokenPlus:     "addition",
+	TokenAsterisk: "multiplication",
+	TokenSlash:    "division",
+}
+
+// The accepted kinds of the arguments of the arithmetic operators, the top of
+// the stack goes first
+var ArithmeticOverloads = map[TokenKind][][]TokenKind{
+	TokenDash: {
+		{TokenTimestamp, TokenTimestamp},
+		{TokenNumber, TokenNumber},
+	},
+	TokenPlus: {
+		{TokenTimestamp, TokenTimestamp},
+		{TokenNumber, TokenNumber},
+	},
+	TokenAsterisk: {
+		{TokenNumber, TokenTimestamp},
+		{TokenTimestamp, TokenNumber},
+		{TokenNumber, TokenNumber},
+	},
+	TokenSlash: {
+		{TokenNumber, TokenTimestamp},
+		{TokenTimestamp, TokenTimestamp},
+		{TokenNumber, TokenNumber},
+	},
+}
+
+// The kind of the poisoned value that replaces the result of the arithmetic
+// operation that could not be performed. The kind of an operand that is not a
+// number or a timestamp, like the one of a poisoned value of an unknown kind,
+// is assumed to be the same as of the other one.
+func poisonedArithmeticKind(op TokenKind, a TokenKind, b TokenKind) TokenKind {
+	isArithmetic := func(kind TokenKind) bool {
+		return kind == TokenNumber || kind == TokenTimestamp
+	}
+	if !isArithmetic(a) {
+		a = b
+	}
+	if !isArithmetic(b) {
+		b = a
+	}
+	if !isArithmetic(a) {
+		return TokenTimestamp
+	}
+	return arithmeticResultKind(op, a, b)
+}
+
+func (context *EvalContext) evalArithmetic(token Token) bool {
+	n := len(context.argsStack)
+	// The arguments are gone from the stack after a failed type check, so
+	// the kind of the poisoned result is figured out beforehand
+	kindAt := func(index int) TokenKind {
+		if index < 0 {
+			return TokenEOF
+		}
+		return context.argsStack[index].Kind
+	}
+	poisonedKind := poisonedArithmeticKind(token.Kind, kindAt(n-2), kindAt(n-1))
+
+	if n >= 2 && (context.argsStack[n-1].Poisoned || context.argsStack[n-2].Poisoned) {
+		context.argsStack = context.argsStack[:n-2]
+		context.argsStack = append(context.argsStack, poisonedValue(token.Loc, poisonedKind))
+		return true
+	}
+
+	overloads := ArithmeticOverloads[token.Kind]
+	args, _, err := context.typeCheckOverloads(token.Loc, overloads...)
+	if err != nil {
+		Diags.Error(token.Loc, "type check failed for %s", ArithmeticNames[token.Kind]).NoteErr(err)
+		context.argsStack = context.argsStack[:max(n-2, 0)]
+		context.argsStack = append(context.argsStack, poisonedValue(token.Loc, poisonedKind))
+		return false
+	}
+	a := args[1]
+	b := args[0]
+
+	result := Token{
+		Loc:  token.Loc,
+		Kind: arithmeticResultKind(token.Kind, a.Kind, b.Kind),
+	}
+	switch token.Kind {
+	case TokenDash:
+		result.Timestamp = a.Timestamp - b.Timestamp
+		result.Number = a.Number - b.Number
+	case TokenPlus:
+		result.Timestamp = a.Timestamp + b.Timestamp
+		result.Number = a.Number + b.Number
+	case TokenAsterisk:
+		if a.Kind == TokenNumber && b.Kind == TokenNumber {
+			result.Number = a.Number * b.Number
+		} else {
+			if a.Kind == TokenNumber {
+				a, b = b, a
+			}
+			result.Timestamp = Millis(math.Round(float64(a.Timestamp) * b.Number))
+		}
+	case TokenSlash:
+		if (b.Kind == TokenNumber && b.Number == 0) || (b.Kind == TokenTimestamp && b.Timestamp == 0) {
+			Diags.Error(b.Loc, "division by zero")
+			context.argsStack = append(context.argsStack, poisonedValue(token.Loc, result.Kind))
+			return false
+		}
+		switch {
+		case a.Kind == TokenTimestamp && b.Kind == TokenNumber:
+			result.Timestamp = Millis(math.Round(float64(a.Timestamp) / b.Number))
+		case a.Kind == TokenTimestamp && b.Kind == TokenTimestamp:
+			result.Number = float64(a.Timestamp) / float64(b.Timestamp)
+		default:
+			result.Number = a.Number / b.Number
+		}
+	}
+	context.argsStack = append(context.argsStack, result)
+	return true
+}
+
+func poisonedValue(loc Loc, kind TokenKind) Token {
+	return Token{
+		Kind:     kind,
+		Loc:      loc,
+		Poisoned: true,
+	}
+}
+
+func (context *EvalContext) pushPoisonedOuts(loc Loc, signature Signature) {
+	for _, param := range signature.Outs {
+		kind := TokenEOF
+		if len(param.Kinds) > 0 {
+			kind = param.Kinds[0]
+		}
+		context.argsStack = append(context.argsStack, poisonedValue(loc, kind))
+	}
+}
+
+// Calls the func recovering from its errors. On failure the argsStack is
+// resynchronized as if the func succeeded: its arguments are consumed and its
+// outputs are replaced with poisoned values, so the evaluation can keep going
+// and report the rest of the problems in the file.
+func (context *EvalContext) callFunc(command string, f Func, token Token) bool {
+	depth := max(len(context.argsStack)-len(f.Signature.Ins), 0)
+	args, err := context.typeCheckSignature(token.Loc, f.Signature)
+	if err != nil {
+		Diags.Error(token.Loc, "type check failed for %s", command).NoteErr(err)
+		context.argsStack = context.argsStack[:min(depth, len(context.argsStack))]
+		context.pushPoisonedOuts(token.Loc, f.Signature)
+		return false
+	}
+	for i, arg := range args {
+		param := f.Signature.Ins[len(args)-1-i]
+		// Poisoned values are only moved around by the funcs that accept
+		// anything. The rest of the funcs would just report the consequences
+		// of the problem that was already reported.
+		if arg.Poisoned && len(param.Kinds) > 0 {
+			context.pushPoisonedOuts(token.Loc, f.Signature)
+			return true
+		}
+	}
+	if !f.Run(context, command, token, args) {
+		// The funcs push their outputs only on success, except the ones like
+		// `map` that take care of that themselves
+		if len(context.argsStack) == depth {
+			context.pushPoisonedOuts(token.Loc, f.Signature)
+		}
+		return false
+	}
+	return true
+}
+
+func (context *EvalContext) evalToken(token Token) bool {
+	switch token.Kind {
+	case TokenDash:
+		fallthrough
+	case TokenPlus:
+		fallthrough
+	case TokenAsterisk:
+		fallthrough
+	case TokenSlash:
+		return context.evalArithmetic(token)
+	case TokenFrames:
+		timestamp, ok := context.framesToTimestamp(token)
+		if !ok {
+			context.argsStack = append(context.argsStack, poisonedValue(token.Loc, TokenTimestamp))
+			return false
+		}
+		context.argsStack = append(context.argsStack, timestamp)
+	case TokenString:
+		fallthrough
+	case TokenBool:
+		fallthrough
+	case TokenNumber:
+		fallthrough
+	case TokenList:
+		fallthrough
+	case TokenBlock:
+		fallthrough
+	case TokenTimestamp:
+		context.argsStack = append(context.argsStack, token)
+	case TokenSymbol:
+		command := string(token.Text)
+		if f, ok := funcs[command]; ok {
+			return context.callFunc(command, f, token)
+		}
+		if word, ok := context.words[command]; ok {
+			return context.callWord(command, word, token)
+		}
+		if variable, ok := context.vars[command]; ok {
+			value := variable.Value
+			value.Loc = token.Loc
+			context.argsStack = append(context.argsStack, value)
+			return true
+		}
+		Diags.Error(token.Loc, "Unknown command %s", command)
+		return false
+	default:
+		Diags.Error(token.Loc, "Unexpected token %s", TokenKindName[token.Kind])
+		return false
+	}
+	return true
+}
+
+// Keeps evaluating after the errors to report as many of them as possible
+func (context *EvalContext) evalNodes(nodes []Node) bool {
+	ok := true
+	for _, node := range nodes {
+		if context.aborted {
+			return false
+		}
+		if node.Kind == NodeComment {
+			continue
+		}
+		if !context.evalNode(node) {
+			ok = false
+		}
+	}
+	return ok
+}
+
+func (context *EvalContext) evalNode(node Node) bool {
+	if context.tracer != nil {
+		if !context.tracer.Before(context, node) {
+			return false
+		}
+		ok := context.evalNodeUntraced(node)
+		context.tracer.After(context, node, ok)
+		return ok
+	}
+	return context.evalNodeUntraced(node)
+}
+
+func (context *EvalContext) evalNodeUntraced(node Node) bool {
+	switch node.Kind {
+	case NodeToken:
+		return context.evalToken(node.Token)
+	case NodeBlock:
+		context.argsStack = append(context.argsStack, Token{
+			Kind:  TokenBlock,
+			Text:  node.Token.Text,
+			Block: node.Children,
+			Loc:   node.Token.Loc,
+		})
+		return true
+	case NodeList:
+		depth := len(context.argsStack)
+		ok := context.evalNodes(node.Children)
+		list, err := context.collectList(node.Token.Loc, depth)
+		if err != nil {
+			Diags.Err(err).Note(node.CloseLoc, "the list is closed here")
+			list = poisonedValue(node.Token.Loc, TokenList)
+			ok = false
+		}
+		context.argsStack = append(context.argsStack, list)
+		return ok
+	default:
+		panic("unreachable")
+	}
+}
+
+// Reports all the syntax errors of the file before evaluating anything
+func (context *EvalContext) evalParsedFile(file *File) bool {
+	if len(file.Errors) > 0 {
+		for _, err := range file.Errors {
+			Diags.Err(err)
+		}
+		return false
+	}
+	return context.evalNodes(file.Nodes)
+}
+
+type IncludeFrame struct {
+	// Location of the `include` that brought the file in. nil for the files
+	// that are evaluated directly
+	Loc  *Loc
+	Path string
+}
+
+func includeKey(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
+}
+
+// Relative paths are looked up next to the including file first and then in
+// the folders of the include search path. If the file is not found anywhere
+// the path next to the including file is returned, so the error mentions it.
+func resolveIncludePath(from string, includePath []string, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	local := filepath.Join(filepath.Dir(from), path)
+	if _, err := os.Stat(local); err == nil {
+		return local
+	}
+	for _, dir := range includePath {
+		candidate := filepath.Join(dir, path)
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate
+		}
+	}
+	return local
+}
+
+func includeChainToString(frames []IncludeFrame, path string) string {
+	chain := []string{}
+	for _, frame := range frames {
+		chain = append(chain, frame.Path)
+	}
+	chain = append(chain, path)
+	return strings.Join(chain, " -> ")
+}
+
+func (context *EvalContext) evalMarkutContent(content string, path string) bool {
+	return context.evalFileContent(nil, content, path)
+}
+
+func (context *EvalContext) evalFileContent(loc *Loc, content string, path string) bool {
+	key := includeKey(path)
+	for _, frame := range context.including {
+		if includeKey(frame.Path) != key {
+			continue
+		}
+		var at Loc
+		if loc != nil {
+			at = *loc
+		}
+		report := Diags.Error(at, "include cycle: %s", includeChainToString(context.including, path))
+		for i := len(context.including) - 1; i >= 0; i -= 1 {
+			if including := context.including[i]; including.Loc != nil {
+				report.Note(*including.Loc, "%s is included here", including.Path)
+			}
+		}
+		return false
+	}
+	if context.included == nil {
+		context.included = map[string]bool{}
+	}
+	context.included[key] = true
+	context.including = append(context.including, IncludeFrame{Loc: loc, Path: path})
+	ok := context.evalParsedFile(ParseMarkutContent(content, path))
+	context.including = context.including[:len(context.including)-1]
+	return ok
+}
+
+func (context *EvalContext) evalMarkutFile(loc *Loc, path string, ignoreIfMissing bool) bool {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		var at Loc
+		if loc != nil {
+			at = *loc
+		}
+		if ignoreIfMissing {
+			return !Diags.Warning("missing-include", at, "%s", err).Fatal
+		}
+		Diags.Error(at, "%s", err)
+		return false
+	}
+
+	return context.evalFileContent(loc, string(content), path)
+}
+
+func (context *EvalContext) includeFile(path Token, ignoreIfMissing bool, once bool) bool {
+	resolved := resolveIncludePath(path.Loc.FilePath, context.includePath, string(path.Text))
+	if once && context.included[includeKey(resolved)] {
+		return true
+	}
+	return context.evalMarkutFile(&path.Loc, resolved, ignoreIfMissing)
 }
 
 func (context *EvalContext) finishEval() bool {
@@ -524,8 +1530,8 @@ func (context *EvalContext) finishEval() bool {
 		duration := context.chapters[i+1].Timestamp - context.chapters[i].Timestamp
 		// TODO: angled brackets are not allowed on YouTube. Let's make `chapters` check for that too.
 		if duration < MinYouTubeChapterDuration {
-			fmt.Printf("%s: ERROR: the chapter \"%s\" has duration %s which is shorter than the minimal allowed YouTube chapter duration which is %s (See https://support.google.com/youtube/answer/9884579)\n", context.chapters[i].Loc, context.chapters[i].Label, millisToTs(duration), millisToTs(MinYouTubeChapterDuration))
-			fmt.Printf("%s: NOTE: the chapter ends here\n", context.chapters[i+1].Loc)
+			Diags.Error(context.chapters[i].Loc, "the chapter \"%s\" has duration %s which is shorter than the minimal allowed YouTube chapter duration which is %s (See https://support.google.com/youtube/answer/9884579)", context.chapters[i].Label, millisToTs(duration), millisToTs(MinYouTubeChapterDuration)).
+				Note(context.chapters[i+1].Loc, "the chapter ends here")
 			ok = false
 		}
 	}
@@ -533,34 +1539,41 @@ func (context *EvalContext) finishEval() bool {
 	if len(context.chapters) > 0 {
 		first := context.chapters[0]
 		if first.Timestamp > 0 {
-			fmt.Printf("%s: ERROR: first chapter must start at 0:00:00 of the output video. But this one starts at %s (See https://support.google.com/youtube/answer/9884579)\n", first.Loc, millisToTs(first.Timestamp));
+			Diags.Error(first.Loc, "first chapter must start at 0:00:00 of the output video. But this one starts at %s (See https://support.google.com/youtube/answer/9884579)", millisToTs(first.Timestamp))
 			ok = false
 		}
 	}
 
 	if len(context.argsStack) > 0 || len(context.chapStack) > 0 {
 		for i := range context.argsStack {
-			fmt.Printf("%s: ERROR: unused argument\n", context.argsStack[i].Loc)
+			if context.argsStack[i].Poisoned {
+				continue
+			}
+			Diags.Error(context.argsStack[i].Loc, "unused argument")
 		}
 		for i := range context.chapStack {
-			fmt.Printf("%s: ERROR: unused chapter\n", context.chapStack[i].Loc)
+			Diags.Error(context.chapStack[i].Loc, "unused chapter")
 		}
 		ok = false
 	}
 
 	for i := range context.cuts {
 		if !context.cuts[i].closed {
-			fmt.Printf("%s: ERROR: unclosed cut\n", context.cuts[i].startLoc);
+			Diags.Error(context.cuts[i].startLoc, "unclosed cut")
 			ok = false
 		}
 	}
 
+	ok = context.checkTransitions() && ok
+
 	return ok
 }
 
-func ffmpegPathToBin() (ffmpegPath string) {
+func ffmpegPathToBin(context EvalContext) (ffmpegPath string) {
 	ffmpegPath = "ffmpeg"
-	// TODO: replace FFMPEG_PREFIX envar in favor of a func `ffmpeg_prefix` that you have to call in $HOME/.markut
+	if context.ffmpegPrefix != nil {
+		return path.Join(string(context.ffmpegPrefix.Text), "bin", "ffmpeg")
+	}
 	ffmpegPrefix, ok := os.LookupEnv("FFMPEG_PREFIX")
 	if ok {
 		ffmpegPath = path.Join(ffmpegPrefix, "bin", "ffmpeg")
@@ -602,7 +1615,7 @@ func ffmpegCutChunk(context EvalContext, chunk Chunk) error {
 		return err
 	}
 
-	ffmpeg := ffmpegPathToBin()
+	ffmpeg := ffmpegPathToBin(context)
 	args := []string{}
 
 	// We always rerender unfinished-chunk.mp4, because it might still
@@ -613,11 +1626,15 @@ func ffmpegCutChunk(context EvalContext, chunk Chunk) error {
 	// the beginning of the function.
 	args = append(args, "-y")
 
-	args = append(args, "-ss", millisToSecsForFFmpeg(chunk.Start))
-	for _, inFlag := range context.ExtraInFlags {
-		args = append(args, string(inFlag.Text))
+	if chunk.Transition != nil {
+		args = append(args, ffmpegTransitionArgs(context, *chunk.Transition)...)
+	} else {
+		args = append(args, "-ss", millisToSecsForFFmpeg(chunk.Start))
+		for _, inFlag := range context.ExtraInFlags {
+			args = append(args, string(inFlag.Text))
+		}
+		args = append(args, "-i", chunk.InputPath)
 	}
-	args = append(args, "-i", chunk.InputPath)
 
 	if context.VideoCodec != nil {
 		args = append(args, "-c:v", string(context.VideoCodec.Text))
@@ -639,9 +1656,12 @@ func ffmpegCutChunk(context EvalContext, chunk Chunk) error {
 	} else {
 		args = append(args, "-ab", DefaultAudioBitrate)
 	}
-	args = append(args, "-t", millisToSecsForFFmpeg(chunk.Duration()))
-	if chunk.Blur {
-		args = append(args, "-vf", "boxblur=50:5")
+	args = append(args, "-t", millisToSecsForFFmpeg(chunk.OutputDuration()))
+	if filter := chunkVideoFilter(chunk, ""); filter != "" && chunk.Transition == nil {
+		args = append(args, "-vf", filter)
+	}
+	if filter := chunkAudioFilter(chunk); filter != "" && chunk.Transition == nil {
+		args = append(args, "-af", filter)
 	}
 	for _, outFlag := range context.ExtraOutFlags {
 		args = append(args, string(outFlag.Text))
@@ -666,8 +1686,147 @@ func ffmpegCutChunk(context EvalContext, chunk Chunk) error {
 	return os.Rename(unfinishedChunkName, chunk.Name())
 }
 
-func ffmpegConcatChunks(listPath string, outputPath string) error {
-	ffmpeg := ffmpegPathToBin()
+// The video filter applied to the whole chunk or an empty string if there is
+// none. label prefixes the names of the intermediate streams, so the filter
+// can be used multiple times within a single filtergraph.
+func chunkVideoFilter(chunk Chunk, label string) string {
+	filters := []string{}
+	if chunk.SpeedFactor() != 1 {
+		filters = append(filters, fmt.Sprintf("setpts=PTS/%g", chunk.SpeedFactor()))
+	}
+	if chunk.Blur {
+		filters = append(filters, "boxblur=50:5")
+	}
+	for i, rect := range chunk.BlurRects {
+		filters = append(filters, rect.Filter(fmt.Sprintf("%sr%d", label, i)))
+	}
+	for _, effect := range chunk.Effects {
+		if effect.Kind == EffectBlur {
+			filters = append(filters, "boxblur=50:5:"+chunk.effectEnable(effect))
+		}
+	}
+	if chunk.FadeIn.Video {
+		filters = append(filters, fmt.Sprintf("fade=t=in:st=0:d=%s", millisToSecsForFFmpeg(chunk.FadeIn.Duration)))
+	}
+	if chunk.FadeOut.Video {
+		filters = append(filters, fmt.Sprintf("fade=t=out:st=%s:d=%s", millisToSecsForFFmpeg(chunk.OutputDuration()-chunk.FadeOut.Duration), millisToSecsForFFmpeg(chunk.FadeOut.Duration)))
+	}
+	return strings.Join(filters, ",")
+}
+
+// Same as chunkVideoFilter but for the audio
+func chunkAudioFilter(chunk Chunk) string {
+	filters := []string{}
+	// atempo preserves the pitch, but older ffmpeg only accepts the factors
+	// between 0.5 and 2.0, so the bigger changes are chained
+	speed := chunk.SpeedFactor()
+	for speed > 2 {
+		filters = append(filters, "atempo=2")
+		speed /= 2
+	}
+	for speed < 0.5 {
+		filters = append(filters, "atempo=0.5")
+		speed /= 0.5
+	}
+	if speed != 1 {
+		filters = append(filters, fmt.Sprintf("atempo=%g", speed))
+	}
+	for _, effect := range chunk.Effects {
+		if effect.Kind == EffectMute {
+			filters = append(filters, "volume=0:"+chunk.effectEnable(effect))
+		}
+	}
+	if chunk.FadeIn.Duration > 0 {
+		filters = append(filters, fmt.Sprintf("afade=t=in:st=0:d=%s", millisToSecsForFFmpeg(chunk.FadeIn.Duration)))
+	}
+	if chunk.FadeOut.Duration > 0 {
+		filters = append(filters, fmt.Sprintf("afade=t=out:st=%s:d=%s", millisToSecsForFFmpeg(chunk.OutputDuration()-chunk.FadeOut.Duration), millisToSecsForFFmpeg(chunk.FadeOut.Duration)))
+	}
+	return strings.Join(filters, ",")
+}
+
+// Common part of `blur_range`, `mute_range` etc
+func (context *EvalContext) addRangedEffect(token Token, args []Token, kind EffectKind) bool {
+	start := args[1]
+	end := args[0]
+	if len(context.chunks) == 0 {
+		Diags.Error(token.Loc, "no chunks defined for the %s effect", EffectKindNames[kind])
+		return false
+	}
+	chunk := &context.chunks[len(context.chunks)-1]
+	if start.Timestamp > end.Timestamp {
+		Diags.Error(end.Loc, "the end of the effect %s is earlier than its start %s", millisToTs(end.Timestamp), millisToTs(start.Timestamp)).
+			Note(start.Loc, "the start is located here")
+		return false
+	}
+	if start.Timestamp < chunk.Start || chunk.End < end.Timestamp {
+		Diags.Error(token.Loc, "the effect %s -> %s is outside of the last defined chunk", millisToTs(start.Timestamp), millisToTs(end.Timestamp)).
+			Note(chunk.Loc, "which is %s -> %s", millisToTs(chunk.Start), millisToTs(chunk.End))
+		return false
+	}
+	chunk.Effects = append(chunk.Effects, RangedEffect{
+		Loc:   token.Loc,
+		Kind:  kind,
+		Start: start.Timestamp,
+		End:   end.Timestamp,
+	})
+	return true
+}
+
+// Common part of `blur_rect` and `pixelate_rect`
+func (context *EvalContext) addBlurRect(token Token, args []Token, pixelate bool) bool {
+	if len(context.chunks) == 0 {
+		Diags.Error(token.Loc, "no chunks defined for a blur")
+		return false
+	}
+	// The args are on the stack in the reversed order
+	values := [4]int{}
+	names := [4]string{"x", "y", "w", "h"}
+	for i := range values {
+		arg := args[len(args)-1-i]
+		if arg.Number < 0 || arg.Number != math.Trunc(arg.Number) {
+			Diags.Error(arg.Loc, "%s of the rectangle must be a non-negative integer but got %g", names[i], arg.Number)
+			return false
+		}
+		values[i] = int(arg.Number)
+	}
+	rect := BlurRect{X: values[0], Y: values[1], W: values[2], H: values[3], Pixelate: pixelate}
+	minSize := 1
+	if pixelate {
+		minSize = PixelateBlockSize
+	}
+	if rect.W < minSize || rect.H < minSize {
+		Diags.Error(token.Loc, "the rectangle must be at least %dx%d but got %dx%d", minSize, minSize, rect.W, rect.H)
+		return false
+	}
+	chunk := &context.chunks[len(context.chunks)-1]
+	chunk.BlurRects = append(chunk.BlurRects, rect)
+	return true
+}
+
+// Common part of `fade_in` and `fade_out`
+func (context *EvalContext) lastChunkFade(token Token, args []Token) (chunk *Chunk, fade Fade, ok bool) {
+	duration := args[1]
+	video := args[0]
+	if len(context.chunks) == 0 {
+		Diags.Error(token.Loc, "no chunks defined for a fade")
+		return
+	}
+	chunk = &context.chunks[len(context.chunks)-1]
+	if duration.Timestamp <= 0 {
+		Diags.Error(duration.Loc, "the duration of the fade must be positive but got %s", millisToTs(duration.Timestamp))
+		return
+	}
+	if duration.Timestamp > chunk.OutputDuration() {
+		Diags.Error(duration.Loc, "the fade of %s is longer than the last defined chunk %s", millisToTs(duration.Timestamp), millisToTs(chunk.OutputDuration())).
+			Note(chunk.Loc, "the chunk is defined here")
+		return
+	}
+	return chunk, Fade{Duration: duration.Timestamp, Video: video.Bool}, true
+}
+
+func ffmpegConcatChunks(context EvalContext, listPath string, outputPath string) error {
+	ffmpeg := ffmpegPathToBin(context)
 	args := []string{}
 
 	// Unlike ffmpegCutChunk(), concatinating chunks is really
@@ -689,8 +1848,8 @@ func ffmpegConcatChunks(listPath string, outputPath string) error {
 	return cmd.Run()
 }
 
-func ffmpegFixupInput(inputPath, outputPath string, y bool) error {
-	ffmpeg := ffmpegPathToBin()
+func ffmpegFixupInput(context EvalContext, inputPath, outputPath string, y bool) error {
+	ffmpeg := ffmpegPathToBin(context)
 	args := []string{}
 
 	if y {
@@ -736,6 +1895,16 @@ type Subcommand struct {
 	Description string
 }
 
+// Parses the flags of a subcommand along with the diagnostic flags that are
+// accepted by all the subcommands
+func parseSubcommandFlags(flagSet *flag.FlagSet, args []string) error {
+	args, err := Diags.ParseFlags(flagSet, args)
+	if err != nil {
+		return err
+	}
+	return flagSet.Parse(args)
+}
+
 var Subcommands = map[string]Subcommand{
 	"fixup": {
 		Description: "Fixup the initial footage",
@@ -745,25 +1914,31 @@ var Subcommands = map[string]Subcommand{
 			outputPtr := subFlag.String("output", "input.ts", "Path to the output video file")
 			yPtr := subFlag.Bool("y", false, "Pass -y to ffmpeg")
 
-			err := subFlag.Parse(args)
+			err := parseSubcommandFlags(subFlag, args)
 			if err == flag.ErrHelp {
 				return true
 			}
 
 			if err != nil {
-				fmt.Printf("ERROR: Could not parse command line arguments: %s\n", err)
+				Diags.Error(Loc{}, "Could not parse command line arguments: %s", err)
 				return false
 			}
 
 			if *inputPtr == "" {
 				subFlag.Usage()
-				fmt.Printf("ERROR: No -input file is provided\n")
+				Diags.Error(Loc{}, "No -input file is provided")
+				return false
+			}
+
+			// Only for picking up `ffmpeg_prefix` from $HOME/.markut
+			context, ok := defaultContext()
+			if !ok {
 				return false
 			}
 
-			err = ffmpegFixupInput(*inputPtr, *outputPtr, *yPtr)
+			err = ffmpegFixupInput(context, *inputPtr, *outputPtr, *yPtr)
 			if err != nil {
-				fmt.Printf("ERROR: Could not fixup input file %s: %s\n", *inputPtr, err)
+				Diags.Error(Loc{}, "Could not fixup input file %s: %s", *inputPtr, err)
 				return false
 			}
 			fmt.Printf("Generated %s\n", *outputPtr)
@@ -777,99 +1952,61 @@ var Subcommands = map[string]Subcommand{
 			subFlag := flag.NewFlagSet(name, flag.ContinueOnError)
 			markutPtr := subFlag.String("markut", "MARKUT", "Path to the MARKUT file")
 
-			err := subFlag.Parse(args)
+			err := parseSubcommandFlags(subFlag, args)
 			if err == flag.ErrHelp {
 				return true
 			}
 
 			if err != nil {
-				fmt.Printf("ERROR: Could not parse command line arguments: %s\n", err)
+				Diags.Error(Loc{}, "Could not parse command line arguments: %s", err)
 				return false
 			}
 
 			context, ok := defaultContext()
-			ok = ok && context.evalMarkutFile(nil, *markutPtr, false) && context.finishEval()
+			ok = context.evalMarkutFile(nil, *markutPtr, false) && ok
+			ok = context.finishEval() && ok
 			if !ok {
 				return false
 			}
 
 			if len(context.chunks) == 0 {
-				fmt.Printf("ERROR: No chunks defined. Nothing could be rendered I guess.\n");
+				Diags.Error(Loc{}, "No chunks defined. Nothing could be rendered I guess.")
 				return false;
 			}
 
 			for i, cut := range context.cuts {
-				startChunk  := cut.startChunk
-				startOffset := cut.startOffset
-				if startChunk < 0 {
-					startChunk = 0
-					startOffset = context.chunks[startChunk].Duration();
-				}
-				if startOffset > context.chunks[startChunk].Duration() {
-					fmt.Printf("%s: TODO: overflowing start offset is not implemented yet\n", cut.startLoc)
-					return false
-				}
-				endChunk  := cut.endChunk
-				endOffset := cut.endOffset
-				if endChunk >= len(context.chunks) {
-					endChunk := len(context.chunks)-1
-					endOffset = context.chunks[endChunk].Duration();
-				}
-				if endOffset > context.chunks[endChunk].Duration() {
-					fmt.Printf("%s: TODO: overflowing end offset is not implemented yet\n", cut.endLoc)
+				cutChunks := context.cutChunks(cut)
+				if len(cutChunks) == 0 {
+					Diags.Error(cut.startLoc, "the cut does not cover any part of the final video").
+						Note(cut.endLoc, "the cut ends here")
 					return false
 				}
-				if startChunk >= endChunk {
-					fmt.Printf("%s: TODO: we don't handle overlapping start and end chunks\n", cut.endLoc);
-					fmt.Printf("%s: TODO: start is here\n", cut.startLoc);
-					return false;
-					// I think this may happen like this
-					// ```markut
-					// 5 cut_start
-					// 69 420 chunk
-					// 5 cut_end
-					// ```
-				}
-				var cutChunks []Chunk
-				cutChunks = append(cutChunks, Chunk{
-					Start:     context.chunks[startChunk].End - startOffset,
-					End:       context.chunks[startChunk].End,
-					InputPath: context.chunks[startChunk].InputPath,
-					// TODO: this should probably copy the rest of the properties of the original chunk
-				})
-				for chunk := startChunk + 1; chunk <= endChunk - 1; chunk += 1 {
-					cutChunks = append(cutChunks, context.chunks[chunk]);
-				}
-				cutChunks = append(cutChunks, Chunk{
-					Start:     context.chunks[endChunk].Start,
-					End:       context.chunks[endChunk].Start + endOffset,
-					InputPath: context.chunks[endChunk].InputPath,
-					// TODO: this should probably copy the rest of the properties of the original chunk
-				})
 
 				for _, chunk := range cutChunks {
 					err := ffmpegCutChunk(context, chunk)
 					if err != nil {
-						fmt.Printf("WARNING: Failed to cut chunk %s: %s\n", chunk.Name(), err)
+						if Diags.Warning("cut-failed", Loc{}, "Failed to cut chunk %s: %s", chunk.Name(), err).Fatal {
+							return false
+						}
 					}
 				}
 
 				listPath := fmt.Sprintf("cut-%02d-list.txt", i)
 				err = ffmpegGenerateConcatList(cutChunks, listPath)
 				if err != nil {
-					fmt.Printf("ERROR: Could not generate not generate concat list %s: %s\n", listPath, err)
+					Diags.Error(Loc{}, "Could not generate not generate concat list %s: %s", listPath, err)
 					return false
 				}
 
 				cutOutputPath := fmt.Sprintf("cut-%02d.mp4", i)
-				err = ffmpegConcatChunks(listPath, cutOutputPath)
+				err = ffmpegConcatChunks(context, listPath, cutOutputPath)
 				if err != nil {
-					fmt.Printf("ERROR: Could not generate output file %s: %s\n", cutOutputPath, err)
+					Diags.Error(Loc{}, "Could not generate output file %s: %s", cutOutputPath, err)
 					return false
 				}
 
 				fmt.Printf("Generated %s\n", cutOutputPath)
-				fmt.Printf("%s: NOTE: cut is defined in here\n", context.cuts[i].endLoc)
+				Diags.Note(context.cuts[i].endLoc, "cut is defined in here")
 			}
 
 			return true
@@ -882,25 +2019,26 @@ var Subcommands = map[string]Subcommand{
 			markutPtr := subFlag.String("markut", "MARKUT", "Path to the MARKUT file")
 			chunkPtr := subFlag.Int("chunk", 0, "Chunk number to render")
 
-			err := subFlag.Parse(args)
+			err := parseSubcommandFlags(subFlag, args)
 
 			if err == flag.ErrHelp {
 				return true
 			}
 
 			if err != nil {
-				fmt.Printf("ERROR: Could not parse command line arguments: %s\n", err)
+				Diags.Error(Loc{}, "Could not parse command line arguments: %s", err)
 				return false
 			}
 
 			context, ok := defaultContext()
-			ok = ok && context.evalMarkutFile(nil, *markutPtr, false) && context.finishEval()
+			ok = context.evalMarkutFile(nil, *markutPtr, false) && ok
+			ok = context.finishEval() && ok
 			if !ok {
 				return false
 			}
 
 			if *chunkPtr > len(context.chunks) {
-				fmt.Printf("ERROR: %d is an incorrect chunk number. There is only %d of them.\n", *chunkPtr, len(context.chunks))
+				Diags.Error(Loc{}, "%d is an incorrect chunk number. There is only %d of them.", *chunkPtr, len(context.chunks))
 				return false
 			}
 
@@ -908,7 +2046,7 @@ var Subcommands = map[string]Subcommand{
 
 			err = ffmpegCutChunk(context, chunk)
 			if err != nil {
-				fmt.Printf("ERROR: Could not cut the chunk %s: %s\n", chunk.Name(), err)
+				Diags.Error(Loc{}, "Could not cut the chunk %s: %s", chunk.Name(), err)
 				return false
 			}
 
@@ -922,45 +2060,49 @@ var Subcommands = map[string]Subcommand{
 			subFlag := flag.NewFlagSet(name, flag.ContinueOnError)
 			markutPtr := subFlag.String("markut", "MARKUT", "Path to the MARKUT file")
 
-			err := subFlag.Parse(args)
+			err := parseSubcommandFlags(subFlag, args)
 			if err == flag.ErrHelp {
 				return true
 			}
 
 			if err != nil {
-				fmt.Printf("ERROR: Could not parse command line arguments: %s\n", err)
+				Diags.Error(Loc{}, "Could not parse command line arguments: %s", err)
 				return false
 			}
 
 			context, ok := defaultContext()
-			ok = ok && context.evalMarkutFile(nil, *markutPtr, false) && context.finishEval()
+			ok = context.evalMarkutFile(nil, *markutPtr, false) && ok
+			ok = context.finishEval() && ok
 			if !ok {
 				return false
 			}
 
-			for _, chunk := range context.chunks {
+			chunks := context.renderChunks()
+			for _, chunk := range chunks {
 				err := ffmpegCutChunk(context, chunk)
 				if err != nil {
-					fmt.Printf("WARNING: Failed to cut chunk %s: %s\n", chunk.Name(), err)
+					if Diags.Warning("cut-failed", Loc{}, "Failed to cut chunk %s: %s", chunk.Name(), err).Fatal {
+						return false
+					}
 				}
 			}
 
 			listPath := "final-list.txt"
-			err = ffmpegGenerateConcatList(context.chunks, listPath)
+			err = ffmpegGenerateConcatList(chunks, listPath)
 			if err != nil {
-				fmt.Printf("ERROR: Could not generate final concat list %s: %s\n", listPath, err)
+				Diags.Error(Loc{}, "Could not generate final concat list %s: %s", listPath, err)
 				return false
 			}
 
-			err = ffmpegConcatChunks(listPath, context.outputPath)
+			err = ffmpegConcatChunks(context, listPath, context.outputPath)
 			if err != nil {
-				fmt.Printf("ERROR: Could not generated final output %s: %s\n", context.outputPath, err)
+				Diags.Error(Loc{}, "Could not generated final output %s: %s", context.outputPath, err)
 				return false
 			}
 
 			err = context.PrintSummary()
 			if err != nil {
-				fmt.Printf("ERROR: Could not print summary: %s\n", err)
+				Diags.Error(Loc{}, "Could not print summary: %s", err)
 				return false
 			}
 
@@ -973,26 +2115,27 @@ var Subcommands = map[string]Subcommand{
 			summFlag := flag.NewFlagSet(name, flag.ContinueOnError)
 			markutPtr := summFlag.String("markut", "MARKUT", "Path to the MARKUT file")
 
-			err := summFlag.Parse(args)
+			err := parseSubcommandFlags(summFlag, args)
 
 			if err == flag.ErrHelp {
 				return true
 			}
 
 			if err != nil {
-				fmt.Printf("ERROR: Could not parse command line arguments: %s\n", err)
+				Diags.Error(Loc{}, "Could not parse command line arguments: %s", err)
 				return false
 			}
 
 			context, ok := defaultContext()
-			ok = ok && context.evalMarkutFile(nil, *markutPtr, false) && context.finishEval()
+			ok = context.evalMarkutFile(nil, *markutPtr, false) && ok
+			ok = context.finishEval() && ok
 			if !ok {
 				return false
 			}
 
 			err = context.PrintSummary()
 			if err != nil {
-				fmt.Printf("ERROR: Could not print summary: %s\n", err)
+				Diags.Error(Loc{}, "Could not print summary: %s", err)
 				return false
 			}
 
@@ -1006,19 +2149,20 @@ var Subcommands = map[string]Subcommand{
 			markutPtr := chatFlag.String("markut", "MARKUT", "Path to the MARKUT file")
 			csvPtr := chatFlag.Bool("csv", false, "Generate the chat using the stupid Twich Chat Downloader CSV format. You can then feed this output to tools like SubChat https://github.com/Kam1k4dze/SubChat")
 
-			err := chatFlag.Parse(args)
+			err := parseSubcommandFlags(chatFlag, args)
 
 			if err == flag.ErrHelp {
 				return true
 			}
 
 			if err != nil {
-				fmt.Printf("ERROR: Could not parse command line arguments: %s\n", err)
+				Diags.Error(Loc{}, "Could not parse command line arguments: %s", err)
 				return false
 			}
 
 			context, ok := defaultContext()
-			ok = ok && context.evalMarkutFile(nil, *markutPtr, false) && context.finishEval()
+			ok = context.evalMarkutFile(nil, *markutPtr, false) && ok
+			ok = context.finishEval() && ok
 			if !ok {
 				return false
 			}
@@ -1026,14 +2170,18 @@ var Subcommands = map[string]Subcommand{
 			if *csvPtr {
 				fmt.Printf("%s\n", TwitchChatDownloaderCSVHeader)
 				var cursor Millis = 0
-				for _, chunk := range context.chunks {
+				for i, chunk := range context.chunks {
 					for _, messageGroup := range chunk.ChatLog {
-						timestamp := cursor + messageGroup.TimeOffset - chunk.Start
+						timestamp := cursor + chunk.scaleToOutput(messageGroup.TimeOffset - chunk.Start)
 						for _, message := range messageGroup.Messages {
 							fmt.Printf("%d,%s,%s,\"%s\"\n", timestamp, message.Nickname, message.Color, message.Text)
 						}
 					}
-					cursor += chunk.End - chunk.Start
+					cursor += chunk.OutputDuration()
+					if transition := context.transitionAfter(i); transition != nil {
+						// The next chunk starts during the transition
+						cursor -= transition.Duration
+					}
 				}
 			} else {
 				capacity := 1
@@ -1041,10 +2189,10 @@ var Subcommands = map[string]Subcommand{
 				timeCursor := Millis(0)
 				subRipCounter := 0
 				sb := strings.Builder{}
-				for _, chunk := range context.chunks {
+				for i, chunk := range context.chunks {
 					prevTime := chunk.Start
 					for _, message := range chunk.ChatLog {
-						deltaTime := message.TimeOffset - prevTime
+						deltaTime := chunk.scaleToOutput(message.TimeOffset - prevTime)
 						prevTime = message.TimeOffset
 						if len(ring) > 0 {
 							subRipCounter += 1
@@ -1062,7 +2210,10 @@ var Subcommands = map[string]Subcommand{
 						timeCursor += deltaTime
 						ring = captionsRingPush(ring, message, capacity)
 					}
-					timeCursor += chunk.End - prevTime
+					timeCursor += chunk.scaleToOutput(chunk.End - prevTime)
+					if transition := context.transitionAfter(i); transition != nil {
+						timeCursor -= transition.Duration
+					}
 				}
 			}
 
@@ -1075,26 +2226,27 @@ var Subcommands = map[string]Subcommand{
 			subFlag := flag.NewFlagSet(name, flag.ContinueOnError)
 			markutPtr := subFlag.String("markut", "MARKUT", "Path to the MARKUT file")
 
-			err := subFlag.Parse(args)
+			err := parseSubcommandFlags(subFlag, args)
 
 			if err == flag.ErrHelp {
 				return true
 			}
 
 			if err != nil {
-				fmt.Printf("ERROR: Could not parse command line arguments: %s\n", err)
+				Diags.Error(Loc{}, "Could not parse command line arguments: %s", err)
 				return false
 			}
 
 			context, ok := defaultContext()
-			ok = ok && context.evalMarkutFile(nil, *markutPtr, false) && context.finishEval()
+			ok = context.evalMarkutFile(nil, *markutPtr, false) && ok
+			ok = context.finishEval() && ok
 			if !ok {
 				return false
 			}
 
 			files, err := ioutil.ReadDir(ChunksFolder)
 			if err != nil {
-				fmt.Printf("ERROR: could not read %s folder: %s\n", ChunksFolder, err)
+				Diags.Error(Loc{}, "could not read %s folder: %s", ChunksFolder, err)
 				return false
 			}
 
@@ -1105,7 +2257,7 @@ var Subcommands = map[string]Subcommand{
 						fmt.Printf("INFO: deleting chunk file %s\n", filePath)
 						err = os.Remove(filePath)
 						if err != nil {
-							fmt.Printf("ERROR: could not remove file %s: %s\n", filePath, err)
+							Diags.Error(Loc{}, "could not remove file %s: %s", filePath, err)
 							return false
 						}
 					}
@@ -1125,14 +2277,14 @@ var Subcommands = map[string]Subcommand{
 			markutPtr := subFlag.String("markut", "MARKUT", "Path to the MARKUT file")
 			skipcatPtr := subFlag.Bool("skipcat", false, "Skip concatenation step")
 
-			err := subFlag.Parse(args)
+			err := parseSubcommandFlags(subFlag, args)
 
 			if err == flag.ErrHelp {
 				return true
 			}
 
 			if err != nil {
-				fmt.Printf("ERROR: Could not parse command line arguments: %s\n", err)
+				Diags.Error(Loc{}, "Could not parse command line arguments: %s", err)
 				return false
 			}
 
@@ -1143,13 +2295,14 @@ var Subcommands = map[string]Subcommand{
 				// rsync(1) is as atomic as rename(2). So it's alright for majority of the cases.
 
 				context, ok := defaultContext()
-				ok = ok && context.evalMarkutFile(nil, *markutPtr, false) && context.finishEval()
+				ok = context.evalMarkutFile(nil, *markutPtr, false) && ok
+				ok = context.finishEval() && ok
 				if !ok {
 					return false
 				}
 
 				done := true
-				for _, chunk := range context.chunks {
+				for _, chunk := range context.renderChunks() {
 					if chunk.Unfinished {
 						done = false
 						continue
@@ -1158,7 +2311,7 @@ var Subcommands = map[string]Subcommand{
 					if _, err := os.Stat(chunk.Name()); errors.Is(err, os.ErrNotExist) {
 						err = ffmpegCutChunk(context, chunk)
 						if err != nil {
-							fmt.Printf("ERROR: Could not cut the chunk %s: %s\n", chunk.Name(), err)
+							Diags.Error(Loc{}, "Could not cut the chunk %s: %s", chunk.Name(), err)
 							return false
 						}
 						fmt.Printf("INFO: Waiting for more updates to %s\n", *markutPtr)
@@ -1175,7 +2328,8 @@ var Subcommands = map[string]Subcommand{
 			}
 
 			context, ok := defaultContext()
-			ok = ok && context.evalMarkutFile(nil, *markutPtr, false) && context.finishEval()
+			ok = context.evalMarkutFile(nil, *markutPtr, false) && ok
+			ok = context.finishEval() && ok
 			if !ok {
 				return false
 			}
@@ -1183,22 +2337,22 @@ var Subcommands = map[string]Subcommand{
 			if !*skipcatPtr {
 
 				listPath := "final-list.txt"
-				err = ffmpegGenerateConcatList(context.chunks, listPath)
+				err = ffmpegGenerateConcatList(context.renderChunks(), listPath)
 				if err != nil {
-					fmt.Printf("ERROR: Could not generate final concat list %s: %s\n", listPath, err)
+					Diags.Error(Loc{}, "Could not generate final concat list %s: %s", listPath, err)
 					return false
 				}
 
-				err = ffmpegConcatChunks(listPath, context.outputPath)
+				err = ffmpegConcatChunks(context, listPath, context.outputPath)
 				if err != nil {
-					fmt.Printf("ERROR: Could not generated final output %s: %s\n", context.outputPath, err)
+					Diags.Error(Loc{}, "Could not generated final output %s: %s", context.outputPath, err)
 					return false
 				}
 			}
 
 			err = context.PrintSummary()
 			if err != nil {
-				fmt.Printf("ERROR: Could not print summary: %s\n", err)
+				Diags.Error(Loc{}, "Could not print summary: %s", err)
 				return false
 			}
 
@@ -1212,7 +2366,7 @@ var Subcommands = map[string]Subcommand{
 				name := args[0]
 				funk, ok := funcs[name]
 				if !ok {
-					fmt.Printf("ERROR: no func named %s is found\n", name)
+					Diags.Error(Loc{}, "no func named %s is found", name)
 					return false
 				}
 				fmt.Printf("%s : %s\n", name, funk.Signature)
@@ -1253,20 +2407,20 @@ var Subcommands = map[string]Subcommand{
 			subFlag := flag.NewFlagSet(commandName, flag.ContinueOnError)
 			videoIdPtr := subFlag.String("videoID", "", "Video ID of the Twitch VOD to download")
 
-			err := subFlag.Parse(args)
+			err := parseSubcommandFlags(subFlag, args)
 
 			if err == flag.ErrHelp {
 				return true
 			}
 
 			if err != nil {
-				fmt.Printf("ERROR: Could not parse command line arguments: %s\n", err)
+				Diags.Error(Loc{}, "Could not parse command line arguments: %s", err)
 				return false
 			}
 
 			if *videoIdPtr == "" {
 				subFlag.Usage()
-				fmt.Printf("ERROR: No -videoID is provided\n")
+				Diags.Error(Loc{}, "No -videoID is provided")
 				return false
 			}
 
@@ -1284,13 +2438,13 @@ var Subcommands = map[string]Subcommand{
 				}
 				req, err := http.NewRequest("POST", gqlUrl, strings.NewReader(body))
 				if err != nil {
-					fmt.Printf("ERROR: could not create request for url %s: %s\n", gqlUrl, err)
+					Diags.Error(Loc{}, "could not create request for url %s: %s", gqlUrl, err)
 					return "", false
 				}
 				req.Header.Add("Client-Id", twitchClientId)
 				resp, err := client.Do(req)
 				if err != nil {
-					fmt.Printf("ERROR: could not perform POST request to %s: %s\n", gqlUrl, err)
+					Diags.Error(Loc{}, "could not perform POST request to %s: %s", gqlUrl, err)
 					return "", false
 				}
 				defer resp.Body.Close()
@@ -1388,25 +2542,46 @@ var Subcommands = map[string]Subcommand{
 			return true
 		},
 	},
+	"fmt": {
+		Description: "Rewrite MARKUT files in the canonical layout",
+		Run:         fmtSubcommand,
+	},
+	"repl": {
+		Description: "Interactively evaluate the Markut Language line by line",
+		Run:         replSubcommand,
+	},
+	"trace": {
+		Description: "Evaluate the MARKUT file logging every evaluated token and the state of the stack",
+		Run:         traceSubcommand,
+	},
+	"lsp": {
+		Description: "Run the Language Server Protocol server for MARKUT files over stdio",
+		Run:         lspSubcommand,
+	},
+	"check": {
+		Description: "Check the stack effects of the MARKUT file without evaluating it",
+		Run:         checkSubcommand,
+	},
 	"chapters": {
 		Description: "Generate YouTube chapters list that is easily copy-pastable to the Video Description",
 		Run: func(commandName string, args []string) bool {
 			subFlag := flag.NewFlagSet(commandName, flag.ContinueOnError)
 			markutPtr := subFlag.String("markut", "MARKUT", "Path to the MARKUT file")
 
-			err := subFlag.Parse(args)
+			err := parseSubcommandFlags(subFlag, args)
 
 			if err == flag.ErrHelp {
 				return true
 			}
 
 			if err != nil {
-				fmt.Printf("ERROR: Could not parse command line arguments: %s\n", err)
+				Diags.Error(Loc{}, "Could not parse command line arguments: %s", err)
 				return false
 			}
 
 			context, ok := defaultContext()
-			ok = ok && context.evalMarkutFile(nil, *markutPtr, false) && context.finishEval()
+			ok = context.evalMarkutFile(nil, *markutPtr, false) && ok
+			ok = context.finishEval() && ok
 			if !ok {
 				return false
 			}
@@ -1433,35 +2608,34 @@ func usage() {
 		fmt.Printf("    %s - %s\n", name, Subcommands[name].Description)
 	}
 	fmt.Printf("ENVARS:\n")
-	fmt.Printf("    FFMPEG_PREFIX      Prefix path for a custom ffmpeg distribution\n")
+	fmt.Printf("    FFMPEG_PREFIX      Prefix path for a custom ffmpeg distribution. Overridden by the `ffmpeg_prefix` func\n")
 	fmt.Printf("FILES:\n")
 	fmt.Printf("    $HOME/.markut      File that is always evaluated automatically before the MARKUT file\n")
-}
-
-func main() {
-	if len(os.Args) < 2 {
-		usage()
-		fmt.Printf("ERROR: No subcommand is provided\n")
-		os.Exit(1)
+	fmt.Printf("DIAGNOSTICS (accepted by all the subcommands):\n")
+	for _, line := range DiagFlagsUsage {
+		fmt.Printf("    %s\n", line)
 	}
+}
 
+func init() {
 	funcs = map[string]Func{
 		"chat": {
 			Description: "Load a chat log file generated by https://www.twitchchatdownloader.com/$SPOILER$ which is going to be used by the subsequent `chunk` func calls to include certain messages into the subtitles generated by the `markut chat` subcommand. There could be only one loaded chat log at a time. Repeated calls to the `chat` func replace the currently loaded chat log with another one. The already defined chunks keep the copy of the logs that were loaded at the time of their definition.",
-			Signature:   "<path:String> --",
+			Signature:   Signature{
+				Ins: []Param{param("path", TokenString)},
+			},
 			Category:    "Chat",
-			Run: func(context *EvalContext, command string, token Token) bool {
-				args, err := context.typeCheckArgs(token.Loc, TokenString)
-				if err != nil {
-					fmt.Printf("%s: ERROR: type check failed for %s\n", token.Loc, command)
-					fmt.Printf("%s\n", err)
-					return false
-				}
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
 				path := args[0]
-				context.chatLog, err = loadTwitchChatDownloaderCSVButParseManually(string(path.Text))
-				if err != nil {
-					fmt.Printf("%s: ERROR: could not load the chat logs: %s\n", path.Loc, err)
-					return false
+				if context.skipChatLogs {
+					context.chatLog = nil
+				} else {
+					var err error
+					context.chatLog, err = loadTwitchChatDownloaderCSVButParseManually(context.resolvePath(string(path.Text)))
+					if err != nil {
+						Diags.Error(path.Loc, "could not load the chat logs: %s", err)
+						return false
+					}
 				}
 				context.chatOffset = 0
 				context.chatsLoaded += 1
@@ -1471,36 +2645,32 @@ func main() {
 		"chat_pin": {
 			Description: "Pins the chat timestamp to the specific video timestamp$SPOILER$ for the currently loaded with the `chat` command chat log.",
 			Category:    "Chat",
-			Signature:   "<video:Timestamp> <chat:Timestamp> --",
-			Run: func(context *EvalContext, command string, token Token) bool {
+			Signature:   Signature{
+				Ins: []Param{param("video", TokenTimestamp), param("chat", TokenTimestamp)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
 				if context.chatsLoaded == 0 {
-					fmt.Printf("%s: ERROR: chat pins should be applied after a `chat` command. Otherwise they are applied to nothing.\n", token.Loc)
+					Diags.Error(token.Loc, "chat pins should be applied after a `chat` command. Otherwise they are applied to nothing.")
 					return false
 				}
 				if context.chunksDefinedForCurrentInput > 0  {
-					fmt.Printf("%s: ERROR: chat pins should be applied before any `chunk` commands within a single `input`. This is due to `chunk` commands making copies of the chat slices that are not affected by the consequent chat pins\n", token.Loc);
+					Diags.Error(token.Loc, "chat pins should be applied before any `chunk` commands within a single `input`. This is due to `chunk` commands making copies of the chat slices that are not affected by the consequent chat pins")
 					return false
 				}
 				// TODO: it's important that chat offsets are applied in the sorted order and do not overlap.
 				// Maybe the language should enforce that somehow.
 
-				args, err := context.typeCheckArgs(token.Loc, TokenTimestamp, TokenTimestamp)
-				if err != nil {
-					fmt.Printf("%s: ERROR: type check failed for %s\n", token.Loc, command)
-					fmt.Printf("%s\n", err)
-					return false
-				}
 
 				video := args[1]
 				chat  := args[0]
 
 				if video.Timestamp < 0 {
-					fmt.Printf("%s: ERROR: the video timestamp of the chat pin is negative %s\n", video.Loc, millisToTs(video.Timestamp))
+					Diags.Error(video.Loc, "the video timestamp of the chat pin is negative %s", millisToTs(video.Timestamp))
 					return false
 				}
 
 				if chat.Timestamp < 0 {
-					fmt.Printf("%s: ERROR: the chat timestamp of the chat pin is negative %s\n", chat.Loc, millisToTs(chat.Timestamp))
+					Diags.Error(chat.Loc, "the chat timestamp of the chat pin is negative %s", millisToTs(chat.Timestamp))
 					return false
 				}
 
@@ -1527,8 +2697,8 @@ func main() {
 		"no_chat": {
 			Description: "Clears out the current loaded chat log$SPOILER$ as if nothing is loaded",
 			Category:    "Chat",
-			Signature:   "--",
-			Run: func(context *EvalContext, command string, token Token) bool {
+			Signature:   Signature{},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
 				context.chatLog = []ChatMessageGroup{}
 				context.chatOffset = 0
 				return true
@@ -1537,31 +2707,27 @@ func main() {
 		"chunk": {
 			Description: "Define a chunk$SPOILER$ between `start` and `end` timestamp for the current input defined by the `input` func",
 			Category:    "Chunk",
-			Signature:   "<start:Timestamp> <end:Timestamp> --",
-			Run: func(context *EvalContext, command string, token Token) bool {
-				args, err := context.typeCheckArgs(token.Loc, TokenTimestamp, TokenTimestamp)
-				if err != nil {
-					fmt.Printf("%s: ERROR: type check failed for %s\n", token.Loc, command)
-					fmt.Printf("%s\n", err)
-					return false
-				}
+			Signature:   Signature{
+				Ins: []Param{param("start", TokenTimestamp), param("end", TokenTimestamp)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
 
 				start := args[1]
 				end := args[0]
 
 				if start.Timestamp < 0 {
-					fmt.Printf("%s: ERROR: the start of the chunk is negative %s\n", start.Loc, millisToTs(start.Timestamp))
+					Diags.Error(start.Loc, "the start of the chunk is negative %s", millisToTs(start.Timestamp))
 					return false
 				}
 
 				if end.Timestamp < 0 {
-					fmt.Printf("%s: ERROR: the end of the chunk is negative %s\n", end.Loc, millisToTs(end.Timestamp))
+					Diags.Error(end.Loc, "the end of the chunk is negative %s", millisToTs(end.Timestamp))
 					return false
 				}
 
 				if start.Timestamp > end.Timestamp {
-					fmt.Printf("%s: ERROR: the end of the chunk %s is earlier than its start %s\n", end.Loc, millisToTs(end.Timestamp), millisToTs(start.Timestamp))
-					fmt.Printf("%s: NOTE: the start is located here\n", start.Loc)
+					Diags.Error(end.Loc, "the end of the chunk %s is earlier than its start %s", millisToTs(end.Timestamp), millisToTs(start.Timestamp)).
+						Note(start.Loc, "the start is located here")
 					return false
 				}
 
@@ -1577,9 +2743,9 @@ func main() {
 
 				for _, chapter := range context.chapStack {
 					if chapter.Timestamp < chunk.Start || chunk.End < chapter.Timestamp {
-						fmt.Printf("%s: ERROR: the timestamp %s of chapter \"%s\" is outside of the the current chunk\n", chapter.Loc, millisToTs(chapter.Timestamp), chapter.Label)
-						fmt.Printf("%s: NOTE: which starts at %s\n", start.Loc, millisToTs(start.Timestamp))
-						fmt.Printf("%s: NOTE: and ends at %s\n", end.Loc, millisToTs(end.Timestamp))
+						Diags.Error(chapter.Loc, "the timestamp %s of chapter \"%s\" is outside of the the current chunk", millisToTs(chapter.Timestamp), chapter.Label).
+							Note(start.Loc, "which starts at %s", millisToTs(start.Timestamp)).
+							Note(end.Loc, "and ends at %s", millisToTs(end.Timestamp))
 						return false
 					}
 
@@ -1598,119 +2764,269 @@ func main() {
 		},
 		"blur": {
 			Description: "Blur the last defined chunk$SPOILER$. Useful for bluring out sensitive information.",
-			Signature:   "--",
+			Signature:   Signature{},
 			Category:    "Chunk",
-			Run: func(context *EvalContext, command string, token Token) bool {
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
 				if len(context.chunks) == 0 {
-					fmt.Printf("%s: ERROR: no chunks defined for a blur\n", token.Loc)
+					Diags.Error(token.Loc, "no chunks defined for a blur")
 					return false
 				}
 				context.chunks[len(context.chunks)-1].Blur = true
 				return true
 			},
 		},
-		"removed": {
-			Description: "Remove the last defined chunk$SPOILER$. Useful for disabling a certain chunk, so you can reenable it later if needed.",
-			Signature:   "--",
+		"transition": {
+			Description: "Add a transition between the last defined chunk and the next one.$SPOILER$ `kind` is one of `crossfade`, `dip_to_black` or `audio_crossfade` (hard cut for the video, crossfade for the audio). The chunks overlap by `duration` of the final video, so it gets shorter by it. For example `0:10:00 0:20:00 chunk \"crossfade\" 0:00:01 transition 0:30:00 0:40:00 chunk`. The transitions are rendered as separate short chunks, so the main chunks are still concatenated without reencoding.",
 			Category:    "Chunk",
-			Run: func(context *EvalContext, command string, token Token) bool {
+			Signature:   Signature{
+				Ins: []Param{param("kind", TokenString), param("duration", TokenTimestamp)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				kindName := args[1]
+				duration := args[0]
+				kind, ok := parseTransitionKind(string(kindName.Text))
+				if !ok {
+					Diags.Error(kindName.Loc, "unknown transition %s. Expected crossfade, dip_to_black or audio_crossfade", string(kindName.Text))
+					return false
+				}
 				if len(context.chunks) == 0 {
-					fmt.Printf("%s: ERROR: no chunks defined for removal\n", token.Loc)
+					Diags.Error(token.Loc, "no chunks defined for a transition")
 					return false
 				}
-				context.chunks = context.chunks[:len(context.chunks)-1]
+				if duration.Timestamp <= 0 {
+					Diags.Error(duration.Loc, "the duration of the transition must be positive but got %s", millisToTs(duration.Timestamp))
+					return false
+				}
+				after := len(context.chunks) - 1
+				if previous := context.transitionAfter(after); previous != nil {
+					Diags.Error(token.Loc, "the last defined chunk already has a transition after it").
+						Note(previous.Loc, "the previous transition is defined here")
+					return false
+				}
+				chunk := context.chunks[after]
+				available := chunk.OutputDuration()
+				if incoming := context.transitionAfter(after - 1); incoming != nil {
+					available -= incoming.Duration
+				}
+				if duration.Timestamp > available {
+					Diags.Error(duration.Loc, "the transition of %s is longer than what is left of the last defined chunk %s", millisToTs(duration.Timestamp), millisToTs(available)).
+						Note(chunk.Loc, "the chunk is defined here")
+					return false
+				}
+				context.transitions = append(context.transitions, Transition{
+					Loc:      token.Loc,
+					Kind:     kind,
+					Duration: duration.Timestamp,
+					After:    after,
+				})
+				// The next chunk overlaps with this one
+				context.chapOffset -= duration.Timestamp
 				return true
 			},
 		},
-		"unfinished": {
-			Description: "Mark the last defined chunk as unfinished$SPOILER$. This is used by the `markut watch` subcommand. `markut watch` does not render any unfinished chunks and keeps monitoring the MARKUT file until there is no unfinished chunks.",
-			Signature:   "--",
+		"fade_in": {
+			Description: "Fade in the audio of the last defined chunk over `duration`$SPOILER$ and the video too if `video` is true. Useful for avoiding the audible pops on the hard cuts between the chunks. For example `0:00:00.2 false fade_in`. Dropped on the side of the chunk joined with another one by a `transition`.",
 			Category:    "Chunk",
-			Run: func(context *EvalContext, command string, token Token) bool {
-				if len(context.chunks) == 0 {
-					fmt.Printf("%s: ERROR: no chunks defined for marking as unfinished\n", token.Loc)
+			Signature:   Signature{
+				Ins: []Param{param("duration", TokenTimestamp), param("video", TokenBool)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				chunk, fade, ok := context.lastChunkFade(token, args)
+				if !ok {
 					return false
 				}
-				context.chunks[len(context.chunks)-1].Unfinished = true
+				chunk.FadeIn = fade
 				return true
 			},
 		},
-		"video_codec": {
-			Description: "Set the value of the output video codec flag (-c:v). Default is \"" + DefaultVideoCodec + "\".",
-			Signature:   "<codec:String> --",
-			Category:    "FFmpeg Arguments",
-			Run: func(context *EvalContext, command string, token Token) bool {
-				args, err := context.typeCheckArgs(token.Loc, TokenString)
-				if err != nil {
-					fmt.Printf("%s: ERROR: type check failed for %s\n", token.Loc, command)
-					fmt.Printf("%s\n", err)
+		"fade_out": {
+			Description: "Same as `fade_in` but fades out at the end of the chunk.",
+			Category:    "Chunk",
+			Signature:   Signature{
+				Ins: []Param{param("duration", TokenTimestamp), param("video", TokenBool)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				chunk, fade, ok := context.lastChunkFade(token, args)
+				if !ok {
+					return false
+				}
+				chunk.FadeOut = fade
+				return true
+			},
+		},
+		"speed": {
+			Description: "Change the playback speed of the last defined chunk by `factor`.$SPOILER$ For example `#4 speed` for a timelapse of a long build. The audio keeps its pitch. The chapters inside of the chunk and everything after it are shifted according to the new duration.",
+			Category:    "Chunk",
+			Signature:   Signature{
+				Ins: []Param{param("factor", TokenNumber)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				factor := args[0]
+				if len(context.chunks) == 0 {
+					Diags.Error(token.Loc, "no chunks defined for changing the speed")
+					return false
+				}
+				if factor.Number <= 0 {
+					Diags.Error(factor.Loc, "the speed factor must be positive but got %g", factor.Number)
+					return false
+				}
+				if transition := context.transitionAfter(len(context.chunks) - 1); transition != nil {
+					Diags.Error(token.Loc, "the speed of the last defined chunk must be changed before adding a transition after it").
+						Note(transition.Loc, "the transition is defined here")
 					return false
 				}
+				chunk := &context.chunks[len(context.chunks)-1]
+				oldDuration := chunk.OutputDuration()
+				oldSpeed := chunk.SpeedFactor()
+				chunk.Speed = factor.Number
+				for _, fade := range []Fade{chunk.FadeIn, chunk.FadeOut} {
+					if fade.Duration > chunk.OutputDuration() {
+						Diags.Error(factor.Loc, "the chunk becomes %s long which is shorter than its fade %s", millisToTs(chunk.OutputDuration()), millisToTs(fade.Duration))
+						chunk.Speed = oldSpeed
+						return false
+					}
+				}
+				// The chapters of the chunk are the ones after the point where
+				// the chunk starts in the final video
+				start := context.chapOffset - oldDuration
+				for i := range context.chapters {
+					if context.chapters[i].Timestamp > start {
+						offset := float64(context.chapters[i].Timestamp - start) * oldSpeed / chunk.SpeedFactor()
+						context.chapters[i].Timestamp = start + Millis(math.Round(offset))
+					}
+				}
+				context.chapOffset = start + chunk.OutputDuration()
+				return true
+			},
+		},
+		"blur_rect": {
+			Description: "Blur the rectangle of the last defined chunk$SPOILER$ with the top left corner at `x` `y` and the size `w` by `h` in pixels. Useful for hiding a leaked token in a terminal window without blurring the whole frame. Can be called multiple times for the same chunk. For example `#100 #200 #640 #48 blur_rect`.",
+			Category:    "Chunk",
+			Signature:   Signature{
+				Ins: []Param{param("x", TokenNumber), param("y", TokenNumber), param("w", TokenNumber), param("h", TokenNumber)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				return context.addBlurRect(token, args, false)
+			},
+		},
+		"pixelate_rect": {
+			Description: "Same as `blur_rect` but pixelates the rectangle instead of blurring it.",
+			Category:    "Chunk",
+			Signature:   Signature{
+				Ins: []Param{param("x", TokenNumber), param("y", TokenNumber), param("w", TokenNumber), param("h", TokenNumber)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				return context.addBlurRect(token, args, true)
+			},
+		},
+		"blur_range": {
+			Description: "Blur the last defined chunk only between `start` and `end`$SPOILER$. The timestamps are the ones of the input just like the ones passed to `chunk`, so there is no need to split the chunk to hide a few seconds of sensitive information. For example `0:12:00 0:15:00 chunk 0:12:01 0:12:04 blur_range`.",
+			Category:    "Chunk",
+			Signature:   Signature{
+				Ins: []Param{param("start", TokenTimestamp), param("end", TokenTimestamp)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				return context.addRangedEffect(token, args, EffectBlur)
+			},
+		},
+		"mute_range": {
+			Description: "Mute the audio of the last defined chunk only between `start` and `end`$SPOILER$. The timestamps are the ones of the input just like for `blur_range`.",
+			Category:    "Chunk",
+			Signature:   Signature{
+				Ins: []Param{param("start", TokenTimestamp), param("end", TokenTimestamp)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				return context.addRangedEffect(token, args, EffectMute)
+			},
+		},
+		"removed": {
+			Description: "Remove the last defined chunk$SPOILER$. Useful for disabling a certain chunk, so you can reenable it later if needed.",
+			Signature:   Signature{},
+			Category:    "Chunk",
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				if len(context.chunks) == 0 {
+					Diags.Error(token.Loc, "no chunks defined for removal")
+					return false
+				}
+				context.chunks = context.chunks[:len(context.chunks)-1]
+				if transition := context.transitionAfter(len(context.chunks)); transition != nil {
+					context.chapOffset += transition.Duration
+					context.transitions = slices.DeleteFunc(context.transitions, func(t Transition) bool {
+						return t.After == len(context.chunks)
+					})
+				}
+				return true
+			},
+		},
+		"unfinished": {
+			Description: "Mark the last defined chunk as unfinished$SPOILER$. This is used by the `markut watch` subcommand. `markut watch` does not render any unfinished chunks and keeps monitoring the MARKUT file until there is no unfinished chunks.",
+			Signature:   Signature{},
+			Category:    "Chunk",
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				if len(context.chunks) == 0 {
+					Diags.Error(token.Loc, "no chunks defined for marking as unfinished")
+					return false
+				}
+				context.chunks[len(context.chunks)-1].Unfinished = true
+				return true
+			},
+		},
+		"video_codec": {
+			Description: "Set the value of the output video codec flag (-c:v). Default is \"" + DefaultVideoCodec + "\".",
+			Signature:   Signature{
+				Ins: []Param{param("codec", TokenString)},
+			},
+			Category:    "FFmpeg Arguments",
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
 				context.VideoCodec = &args[0]
 				return true
 			},
 		},
 		"video_bitrate": {
 			Description: "Set the value of the output video bitrate flag (-vb). Default is \"" + DefaultVideoBitrate + "\".",
-			Signature:   "<bitrate:String> --",
+			Signature:   Signature{
+				Ins: []Param{param("bitrate", TokenString)},
+			},
 			Category:    "FFmpeg Arguments",
-			Run: func(context *EvalContext, command string, token Token) bool {
-				args, err := context.typeCheckArgs(token.Loc, TokenString)
-				if err != nil {
-					fmt.Printf("%s: ERROR: type check failed for %s\n", token.Loc, command)
-					fmt.Printf("%s\n", err)
-					return false
-				}
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
 				context.VideoBitrate = &args[0]
 				return true
 			},
 		},
 		"audio_codec": {
 			Description: "Set the value of the output audio codec flag (-c:a). Default is \"" + DefaultAudioCodec + "\".",
-			Signature:   "<codec:String> --",
+			Signature:   Signature{
+				Ins: []Param{param("codec", TokenString)},
+			},
 			Category:    "FFmpeg Arguments",
-			Run: func(context *EvalContext, command string, token Token) bool {
-				args, err := context.typeCheckArgs(token.Loc, TokenString)
-				if err != nil {
-					fmt.Printf("%s: ERROR: type check failed for %s\n", token.Loc, command)
-					fmt.Printf("%s\n", err)
-					return false
-				}
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
 				context.AudioCodec = &args[0]
 				return true
 			},
 		},
 		"audio_bitrate": {
 			Description: "Set the value of the output audio bitrate flag (-ab). Default is \"" + DefaultAudioBitrate + "\".",
-			Signature:   "<bitrate:String> --",
+			Signature:   Signature{
+				Ins: []Param{param("bitrate", TokenString)},
+			},
 			Category:    "FFmpeg Arguments",
-			Run: func(context *EvalContext, command string, token Token) bool {
-				args, err := context.typeCheckArgs(token.Loc, TokenString)
-				if err != nil {
-					fmt.Printf("%s: ERROR: type check failed for %s\n", token.Loc, command)
-					fmt.Printf("%s\n", err)
-					return false
-				}
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
 				context.AudioBitrate = &args[0]
 				return true
 			},
 		},
 		"chunk_outf": {
 			Description: "Append extra output flag to the last defined chunk",
-			Signature:   "<flag:String> --",
+			Signature:   Signature{
+				Ins: []Param{param("flag", TokenString)},
+			},
 			Category:    "FFmpeg Arguments",
-			Run: func(context *EvalContext, command string, token Token) bool {
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
 				if len(context.chunks) == 0 {
-					fmt.Printf("%s: ERROR: no chunks defined to add extra output flag to\n", token.Loc)
+					Diags.Error(token.Loc, "no chunks defined to add extra output flag to")
 					return false
 				}
 
-				args, err := context.typeCheckArgs(token.Loc, TokenString)
-				if err != nil {
-					fmt.Printf("%s: ERROR: type check failed for %s\n", token.Loc, command)
-					fmt.Printf("%s\n", err)
-					return false
-				}
 				outFlag := args[0]
 
 				chunk := &context.chunks[len(context.chunks)-1];
@@ -1721,15 +3037,11 @@ func main() {
 		},
 		"outf": {
 			Description: "Append extra output flag for every chunk",
-			Signature:   "<flag:String> --",
+			Signature:   Signature{
+				Ins: []Param{param("flag", TokenString)},
+			},
 			Category:    "FFmpeg Arguments",
-			Run: func(context *EvalContext, command string, token Token) bool {
-				args, err := context.typeCheckArgs(token.Loc, TokenString)
-				if err != nil {
-					fmt.Printf("%s: ERROR: type check failed for %s\n", token.Loc, command)
-					fmt.Printf("%s\n", err)
-					return false
-				}
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
 				outFlag := args[0]
 				context.ExtraOutFlags = append(context.ExtraOutFlags, outFlag)
 				return true
@@ -1737,15 +3049,11 @@ func main() {
 		},
 		"inf": {
 			Description: "Append extra input flag for every chunk",
-			Signature:   "<flag:String> --",
+			Signature:   Signature{
+				Ins: []Param{param("flag", TokenString)},
+			},
 			Category:    "FFmpeg Arguments",
-			Run: func(context *EvalContext, command string, token Token) bool {
-				args, err := context.typeCheckArgs(token.Loc, TokenString)
-				if err != nil {
-					fmt.Printf("%s: ERROR: type check failed for %s\n", token.Loc, command)
-					fmt.Printf("%s\n", err)
-					return false
-				}
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
 				inFlag := args[0]
 				context.ExtraInFlags = append(context.ExtraInFlags, inFlag)
 				return true
@@ -1753,79 +3061,61 @@ func main() {
 		},
 		"over": {
 			Description: "Copy the argument below the top of the stack on top",
-			Signature:   "<a:Type1> <b:Type2> -- <a:Type1> <b:Type2> <a:Type1>",
+			Signature:   Signature{
+				Ins:  []Param{typeVar("a", "Type1"), typeVar("b", "Type2")},
+				Outs: []Param{typeVar("a", "Type1"), typeVar("b", "Type2"), typeVar("a", "Type1")},
+			},
 			Category:    "Stack",
-			Run: func(context *EvalContext, command string, token Token) bool {
-				arity := 2
-				if len(context.argsStack) < arity {
-					fmt.Printf("%s: Expected %d arguments but got %d", token.Loc, arity, len(context.argsStack))
-					return false
-				}
-				n := len(context.argsStack)
-				context.argsStack = append(context.argsStack, context.argsStack[n-2])
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				context.argsStack = append(context.argsStack, args[1], args[0], args[1])
 				return true
 			},
 		},
 		"swap": {
 			Description: "Swap two argument on top of the stack",
-			Signature:   "<b:Type2> <a:Type1> -- <a:Type1> <b:Type2>",
+			Signature:   Signature{
+				Ins:  []Param{typeVar("b", "Type2"), typeVar("a", "Type1")},
+				Outs: []Param{typeVar("a", "Type1"), typeVar("b", "Type2")},
+			},
 			Category:    "Stack",
-			Run: func(context *EvalContext, command string, token Token) bool {
-				arity := 2
-				if len(context.argsStack) < arity {
-					fmt.Printf("%s: Expected %d arguments but got %d", token.Loc, arity, len(context.argsStack))
-					return false
-				}
-				n := len(context.argsStack)
-				context.argsStack[n-1], context.argsStack[n-2] = context.argsStack[n-2], context.argsStack[n-1];
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				context.argsStack = append(context.argsStack, args[0], args[1])
 				return true
 			},
 		},
 		"drop": {
 			Description: "Drop the argument on top of the stack",
-			Signature:   "<a:Type1> --",
+			Signature:   Signature{
+				Ins: []Param{typeVar("a", "Type1")},
+			},
 			Category:    "Stack",
-			Run: func(context *EvalContext, command string, token Token) bool {
-				arity := 1
-				if len(context.argsStack) < arity {
-					fmt.Printf("%s: Expected %d arguments but got %d", token.Loc, arity, len(context.argsStack))
-					return false
-				}
-				n := len(context.argsStack)
-				context.argsStack = context.argsStack[:n-1];
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
 				return true
 			},
 		},
 		"dup": {
 			Description: "Duplicate the argument on top of the stack",
-			Signature:   "<a:Type1> -- <a:Type1> <a:Type1>",
+			Signature:   Signature{
+				Ins:  []Param{typeVar("a", "Type1")},
+				Outs: []Param{typeVar("a", "Type1"), typeVar("a", "Type1")},
+			},
 			Category:    "Stack",
-			Run: func(context *EvalContext, command string, token Token) bool {
-				arity := 1
-				if len(context.argsStack) < arity {
-					fmt.Printf("%s: Expected %d arguments but got %d", token.Loc, arity, len(context.argsStack))
-					return false
-				}
-				n := len(context.argsStack)
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
 				// TODO: the location of the dupped value should be the location of the "dup" token
-				context.argsStack = append(context.argsStack, context.argsStack[n-1])
+				context.argsStack = append(context.argsStack, args[0], args[0])
 				return true
 			},
 		},
 		"input": {
 			Description: "Set the current input for the consequent chunks.",
 			Category:    "Misc",
-			Signature:   "<filePath:String> --",
-			Run: func(context *EvalContext, command string, token Token) bool {
-				args, err := context.typeCheckArgs(token.Loc, TokenString)
-				if err != nil {
-					fmt.Printf("%s: ERROR: type check failed for %s\n", token.Loc, command)
-					fmt.Printf("%s\n", err)
-					return false
-				}
+			Signature:   Signature{
+				Ins: []Param{param("filePath", TokenString)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
 				path := args[0]
 				if len(path.Text) == 0 {
-					fmt.Printf("%s: ERROR: cannot set empty input path\n", path.Loc)
+					Diags.Error(path.Loc, "cannot set empty input path")
 					return false
 				}
 				context.inputPath = string(path.Text)
@@ -1837,14 +3127,10 @@ func main() {
 		"chapter": {
 			Description: "Define a new YouTube chapter for within a chunk for `markut summary` command.",
 			Category:    "Misc",
-			Signature:   "<timestamp:Timestamp> <title:String> --",
-			Run: func(context *EvalContext, command string, token Token) bool {
-				args, err := context.typeCheckArgs(token.Loc, TokenString, TokenTimestamp)
-				if err != nil {
-					fmt.Printf("%s: ERROR: type check failed for %s\n", token.Loc, command)
-					fmt.Printf("%s\n", err)
-					return false
-				}
+			Signature:   Signature{
+				Ins: []Param{param("timestamp", TokenTimestamp), param("title", TokenString)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
 				context.chapStack = append(context.chapStack, Chapter{
 					Loc:       args[1].Loc,
 					Label:     string(args[0].Text),
@@ -1856,25 +3142,21 @@ func main() {
 		"cut_end": {
 			Description: "Define cut end for `markut cut` command.",
 			Category:    "Misc",
-			Signature:   "<end:Timestamp> --",
-			Run: func(context *EvalContext, command string, token Token) bool {
-				args, err := context.typeCheckArgs(token.Loc, TokenTimestamp)
-				if err != nil {
-					fmt.Printf("%s: ERROR: type check failed for %s\n", token.Loc, command)
-					fmt.Printf("%s\n", err)
-					return false
-				}
+			Signature:   Signature{
+				Ins: []Param{param("end", TokenTimestamp)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
 				offset := args[0]
 
 				if len(context.cuts) == 0 {
-					fmt.Printf("%s: ERROR: no cuts to close\n", token.Loc);
+					Diags.Error(token.Loc, "no cuts to close")
 					return false;
 				}
 
 				previousCut := &context.cuts[len(context.cuts)-1];
 				if previousCut.closed {
-					fmt.Printf("%s: ERROR: no cuts to close\n", token.Loc);
-					fmt.Printf("%s: NOTE: previous cut was closed here\n", previousCut.endLoc);
+					Diags.Error(token.Loc, "no cuts to close").
+						Note(previousCut.endLoc, "previous cut was closed here")
 					return false;
 				}
 
@@ -1889,21 +3171,17 @@ func main() {
 		"cut_start": {
 			Description: "Define cut start for `markut cut` command.",
 			Category:    "Misc",
-			Signature:   "<start:Timestamp> --",
-			Run: func(context *EvalContext, command string, token Token) bool {
-				args, err := context.typeCheckArgs(token.Loc, TokenTimestamp)
-				if err != nil {
-					fmt.Printf("%s: ERROR: type check failed for %s\n", token.Loc, command)
-					fmt.Printf("%s\n", err)
-					return false
-				}
+			Signature:   Signature{
+				Ins: []Param{param("start", TokenTimestamp)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
 				offset := args[0]
 
 				if len(context.cuts) > 0 {
 					previousCut := context.cuts[len(context.cuts)-1];
 					if !previousCut.closed {
-						fmt.Printf("%s: ERROR: you are starting a new cut before closing the previous one", token.Loc);
-						fmt.Printf("%s: NOTE: the previous cut is started here", previousCut.startLoc);
+						Diags.Error(token.Loc, "you are starting a new cut before closing the previous one").
+							Note(previousCut.startLoc, "the previous cut is started here")
 						return false;
 					}
 				}
@@ -1919,14 +3197,10 @@ func main() {
 		"cut": {
 			Description: "Equivalent to `<offset> cut_start <offset> cut_end`.",
 			Category:    "Misc",
-			Signature:   "<offset:Timestamp> --",
-			Run: func(context *EvalContext, command string, token Token) bool {
-				args, err := context.typeCheckArgs(token.Loc, TokenTimestamp)
-				if err != nil {
-					fmt.Printf("%s: ERROR: type check failed for %s\n", token.Loc, command)
-					fmt.Printf("%s\n", err)
-					return false
-				}
+			Signature:   Signature{
+				Ins: []Param{param("offset", TokenTimestamp)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
 				offset := args[0]
 				context.cuts = append(context.cuts, Cut{
 					startLoc:    token.Loc,
@@ -1941,40 +3215,59 @@ func main() {
 			},
 		},
 		"include": {
-			Description: "Include another MARKUT file and fail if it does not exist.",
+			Description: "Include another MARKUT file and fail if it does not exist.$SPOILER$ Relative paths are resolved against the folder of the including file first and then against the folders added by `include_path`. Including a file that is already being included is reported as an include cycle.",
 			Category:    "Misc",
-			Signature:   "<path:String> --",
-			Run: func(context *EvalContext, command string, token Token) bool {
-				args, err := context.typeCheckArgs(token.Loc, TokenString)
-				if err != nil {
-					fmt.Printf("%s: ERROR: type check failed for %s\n", token.Loc, command)
-					fmt.Printf("%s\n", err)
-					return false
-				}
-				path := args[0]
-				return context.evalMarkutFile(&path.Loc, string(path.Text), false)
+			Signature:   Signature{
+				Ins: []Param{param("path", TokenString)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				return context.includeFile(args[0], false, false)
 			},
 		},
 		"include_if_exists": {
-			Description: "Try to include another MARKUT file but do not fail if it does not exist.",
+			Description: "Try to include another MARKUT file but do not fail if it does not exist.$SPOILER$ The path is resolved the same way as for `include`.",
 			Category:    "Misc",
-			Signature:   "<path:String> --",
-			Run: func(context *EvalContext, command string, token Token) bool {
-				args, err := context.typeCheckArgs(token.Loc, TokenString)
-				if err != nil {
-					fmt.Printf("%s: ERROR: type check failed for %s\n", token.Loc, command)
-					fmt.Printf("%s\n", err)
-					return false
+			Signature:   Signature{
+				Ins: []Param{param("path", TokenString)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				return context.includeFile(args[0], true, false)
+			},
+		},
+		"include_once": {
+			Description: "Include another MARKUT file unless it was already evaluated.$SPOILER$ Useful for the files with shared definitions that are included from many places. The path is resolved the same way as for `include`.",
+			Category:    "Misc",
+			Signature:   Signature{
+				Ins: []Param{param("path", TokenString)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				return context.includeFile(args[0], false, true)
+			},
+		},
+		"include_path": {
+			Description: "Add a folder to the include search path.$SPOILER$ The relative paths passed to `include`, `include_if_exists` and `include_once` that are not found next to the including file are looked up in these folders in the order they were added. A relative `dir` is resolved against the folder of the file that calls `include_path`. Usually called from $HOME/.markut.",
+			Category:    "Misc",
+			Signature:   Signature{
+				Ins: []Param{param("dir", TokenString)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				dir := string(args[0].Text)
+				if !filepath.IsAbs(dir) {
+					dir = filepath.Join(filepath.Dir(args[0].Loc.FilePath), dir)
 				}
-				path := args[0]
-				return context.evalMarkutFile(&path.Loc, string(path.Text), true)
+				if !slices.Contains(context.includePath, dir) {
+					context.includePath = append(context.includePath, dir)
+				}
+				return true
 			},
 		},
 		"home": {
 			Description: "Path to the home folder.",
 			Category:    "Misc",
-			Signature:   "-- <path:String>",
-			Run: func(context *EvalContext, command string, token Token) bool {
+			Signature:   Signature{
+				Outs: []Param{param("path", TokenString)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
 				context.argsStack = append(context.argsStack, Token{
 					Kind: TokenString,
 					Text: []rune(os.Getenv("HOME")),
@@ -1983,17 +3276,749 @@ func main() {
 				return true
 			},
 		},
-		"concat": {
-			Description: "Concatenate two strings.",
+		"env": {
+			Description: "Value of the environment variable `name` or `default` if it is not set.$SPOILER$ For example `\"FOOTAGE_DIR\" \"/mnt/footage\" env` lets every machine point to its own footage folder.",
+			Category:    "Environment",
+			Signature:   Signature{
+				Ins:  []Param{param("name", TokenString), param("default", TokenString)},
+				Outs: []Param{param("value", TokenString)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				value, ok := os.LookupEnv(string(args[1].Text))
+				if !ok {
+					value = string(args[0].Text)
+				}
+				context.argsStack = append(context.argsStack, Token{
+					Kind: TokenString,
+					Text: []rune(value),
+					Loc:  token.Loc,
+				})
+				return true
+			},
+		},
+		"file_exists": {
+			Description: "Check if there is a file or a folder at `path`.",
+			Category:    "Environment",
+			Signature:   Signature{
+				Ins:  []Param{param("path", TokenString)},
+				Outs: []Param{param("result", TokenBool)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				_, err := os.Stat(context.resolvePath(string(args[0].Text)))
+				context.argsStack = append(context.argsStack, Token{
+					Kind: TokenBool,
+					Bool: err == nil,
+					Loc:  token.Loc,
+				})
+				return true
+			},
+		},
+		"basename": {
+			Description: "The last element of `path`.$SPOILER$ For example `\"footage/stream.mp4\" basename` is `\"stream.mp4\"`.",
+			Category:    "Environment",
+			Signature:   Signature{
+				Ins:  []Param{param("path", TokenString)},
+				Outs: []Param{param("name", TokenString)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				context.argsStack = append(context.argsStack, Token{
+					Kind: TokenString,
+					Text: []rune(filepath.Base(string(args[0].Text))),
+					Loc:  token.Loc,
+				})
+				return true
+			},
+		},
+		"dirname": {
+			Description: "All but the last element of `path`.$SPOILER$ For example `\"footage/stream.mp4\" dirname` is `\"footage\"`.",
+			Category:    "Environment",
+			Signature:   Signature{
+				Ins:  []Param{param("path", TokenString)},
+				Outs: []Param{param("dir", TokenString)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				context.argsStack = append(context.argsStack, Token{
+					Kind: TokenString,
+					Text: []rune(filepath.Dir(string(args[0].Text))),
+					Loc:  token.Loc,
+				})
+				return true
+			},
+		},
+		"path_join": {
+			Description: "Join two paths with the path separator.$SPOILER$ For example `home \"footage\" path_join`.",
+			Category:    "Environment",
+			Signature:   Signature{
+				Ins:  []Param{param("a", TokenString), param("b", TokenString)},
+				Outs: []Param{param("a/b", TokenString)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				context.argsStack = append(context.argsStack, Token{
+					Kind: TokenString,
+					Text: []rune(filepath.Join(string(args[1].Text), string(args[0].Text))),
+					Loc:  token.Loc,
+				})
+				return true
+			},
+		},
+		"glob": {
+			Description: "List of the paths matching the shell pattern `pattern` sorted alphabetically.$SPOILER$ For example `\"footage/*.mp4\" glob { input } each`. The list is empty if nothing matches.",
+			Category:    "Environment",
+			Signature:   Signature{
+				Ins:  []Param{param("pattern", TokenString)},
+				Outs: []Param{param("paths", TokenList)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				pattern := args[0]
+				matches, err := filepath.Glob(context.resolvePath(string(pattern.Text)))
+				if err != nil {
+					Diags.Error(pattern.Loc, "invalid glob pattern: %s", err)
+					return false
+				}
+				list := Token{
+					Kind: TokenList,
+					Text: []rune("["),
+					Loc:  token.Loc,
+				}
+				for _, match := range matches {
+					// Keep the paths relative the same way they are
+					// without the base folder
+					if context.baseDir != "" && !filepath.IsAbs(string(pattern.Text)) {
+						if rel, err := filepath.Rel(context.baseDir, match); err == nil {
+							match = rel
+						}
+					}
+					list.List = append(list.List, Token{
+						Kind: TokenString,
+						Text: []rune(match),
+						Loc:  token.Loc,
+					})
+				}
+				context.argsStack = append(context.argsStack, list)
+				return true
+			},
+		},
+		"ffmpeg_prefix": {
+			Description: "Set the prefix path of a custom ffmpeg distribution.$SPOILER$ The ffmpeg binary is expected at `prefix`/bin/ffmpeg. Takes precedence over the FFMPEG_PREFIX envar. Usually called from $HOME/.markut, for example `\"FFMPEG_PREFIX\" \"/opt/ffmpeg\" env ffmpeg_prefix`.",
+			Category:    "FFmpeg Arguments",
+			Signature:   Signature{
+				Ins: []Param{param("prefix", TokenString)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				context.ffmpegPrefix = &args[0]
+				return true
+			},
+		},
+		"define": {
+			Description: "Define a new word$SPOILER$ with the name `name` that evaluates the `body` block every time it is invoked. For example `{ 0:00:05 - swap 0:00:05 + chunk } \"padded_chunk\" define`. The name must be a valid symbol that does not collide with any existing func or word.",
+			Category:    "Words",
+			Signature:   Signature{
+				Ins: []Param{param("body", TokenBlock), param("name", TokenString)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				name := args[0]
+				body := args[1]
+				if !IsValidSymbol(name.Text) {
+					Diags.Error(name.Loc, "\"%s\" is not a valid name for a word", string(name.Text))
+					return false
+				}
+				if _, ok := funcs[string(name.Text)]; ok {
+					Diags.Error(name.Loc, "redefinition of the builtin func %s", string(name.Text))
+					return false
+				}
+				if word, ok := context.words[string(name.Text)]; ok {
+					Diags.Error(name.Loc, "redefinition of the word %s", string(name.Text)).
+						Note(word.Loc, "the word is originally defined here")
+					return false
+				}
+				if variable, ok := context.vars[string(name.Text)]; ok {
+					Diags.Error(name.Loc, "the name %s is already taken by a variable", string(name.Text)).
+						Note(variable.Loc, "the variable is defined here")
+					return false
+				}
+				if context.words == nil {
+					context.words = map[string]Word{}
+				}
+				context.words[string(name.Text)] = Word{
+					Loc:  name.Loc,
+					Body: body.Block,
+				}
+				return true
+			},
+		},
+		"each": {
+			Description: "Evaluate the `body` block for every element of the `list`$SPOILER$ pushing the element onto the stack before each evaluation. For example `[ \"a.mp4\" \"b.mp4\" ] { input 0:00:05 0:00:10 chunk } each`.",
+			Category:    "Lists",
+			Signature:   Signature{
+				Ins: []Param{param("list", TokenList), param("body", TokenBlock)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				body := args[0]
+				list := args[1]
+				depth := len(context.argsStack)
+				for _, element := range list.List {
+					context.argsStack = append(context.argsStack, element)
+					if !context.callBlock(token.Loc, body.Block) {
+						Diags.Note(token.Loc, "in the body of %s", command)
+						context.argsStack = context.argsStack[:min(depth, len(context.argsStack))]
+						return false
+					}
+				}
+				return true
+			},
+		},
+		"map": {
+			Description: "Evaluate the `body` block for every element of the `list` and collect all the produced values into a new list$SPOILER$. Equivalent to `[ <list> <body> each ]`.",
+			Category:    "Lists",
+			Signature:   Signature{
+				Ins:  []Param{param("list", TokenList), param("body", TokenBlock)},
+				Outs: []Param{param("result", TokenList)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				body := args[0]
+				list := args[1]
+				depth := len(context.argsStack)
+				for _, element := range list.List {
+					context.argsStack = append(context.argsStack, element)
+					if !context.callBlock(token.Loc, body.Block) {
+						Diags.Note(token.Loc, "in the body of %s", command)
+						context.argsStack = context.argsStack[:min(depth, len(context.argsStack))]
+						context.argsStack = append(context.argsStack, poisonedValue(token.Loc, TokenList))
+						return false
+					}
+				}
+				result, err := context.collectList(token.Loc, depth)
+				if err != nil {
+					Diags.Err(err)
+					return false
+				}
+				context.argsStack = append(context.argsStack, result)
+				return true
+			},
+		},
+		"length": {
+			Description: "Amount of elements in the list or characters in the string.",
+			Category:    "Lists",
+			Signature:   Signature{
+				Ins:  []Param{param("value", TokenList, TokenString)},
+				Outs: []Param{param("length", TokenNumber)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				length := len(args[0].List)
+				if args[0].Kind == TokenString {
+					length = len(args[0].Text)
+				}
+				context.argsStack = append(context.argsStack, Token{
+					Kind:   TokenNumber,
+					Number: float64(length),
+					Loc:    token.Loc,
+				})
+				return true
+			},
+		},
+		"true": {
+			Description: "Push boolean true onto the stack.",
+			Category:    "Conditionals",
+			Signature:   Signature{
+				Outs: []Param{param("true", TokenBool)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				context.argsStack = append(context.argsStack, Token{
+					Kind: TokenBool,
+					Bool: true,
+					Loc:  token.Loc,
+				})
+				return true
+			},
+		},
+		"false": {
+			Description: "Push boolean false onto the stack.",
+			Category:    "Conditionals",
+			Signature:   Signature{
+				Outs: []Param{param("false", TokenBool)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				context.argsStack = append(context.argsStack, Token{
+					Kind: TokenBool,
+					Bool: false,
+					Loc:  token.Loc,
+				})
+				return true
+			},
+		},
+		"not": {
+			Description: "Logical negation.",
+			Category:    "Conditionals",
+			Signature:   Signature{
+				Ins:  []Param{param("a", TokenBool)},
+				Outs: []Param{param("!a", TokenBool)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				context.argsStack = append(context.argsStack, Token{
+					Kind: TokenBool,
+					Bool: !args[0].Bool,
+					Loc:  token.Loc,
+				})
+				return true
+			},
+		},
+		"and": {
+			Description: "Logical conjunction.",
+			Category:    "Conditionals",
+			Signature:   Signature{
+				Ins:  []Param{param("a", TokenBool), param("b", TokenBool)},
+				Outs: []Param{param("a&&b", TokenBool)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				context.argsStack = append(context.argsStack, Token{
+					Kind: TokenBool,
+					Bool: args[1].Bool && args[0].Bool,
+					Loc:  token.Loc,
+				})
+				return true
+			},
+		},
+		"or": {
+			Description: "Logical disjunction.",
+			Category:    "Conditionals",
+			Signature:   Signature{
+				Ins:  []Param{param("a", TokenBool), param("b", TokenBool)},
+				Outs: []Param{param("a||b", TokenBool)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				context.argsStack = append(context.argsStack, Token{
+					Kind: TokenBool,
+					Bool: args[1].Bool || args[0].Bool,
+					Loc:  token.Loc,
+				})
+				return true
+			},
+		},
+		"=": {
+			Description: "Check if two values of the same type are equal$SPOILER$. Works for Timestamps, Strings, Numbers and Bools.",
+			Category:    "Conditionals",
+			Signature:   Signature{
+				Ins:  []Param{typeVar("a", "Type", ComparableKinds...), typeVar("b", "Type", ComparableKinds...)},
+				Outs: []Param{param("result", TokenBool)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				context.argsStack = append(context.argsStack, Token{
+					Kind: TokenBool,
+					Bool: compareValues(args[1], args[0]) == 0,
+					Loc:  token.Loc,
+				})
+				return true
+			},
+		},
+		"!=": {
+			Description: "Check if two values of the same type are not equal$SPOILER$. Works for Timestamps, Strings, Numbers and Bools.",
+			Category:    "Conditionals",
+			Signature:   Signature{
+				Ins:  []Param{typeVar("a", "Type", ComparableKinds...), typeVar("b", "Type", ComparableKinds...)},
+				Outs: []Param{param("result", TokenBool)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				context.argsStack = append(context.argsStack, Token{
+					Kind: TokenBool,
+					Bool: compareValues(args[1], args[0]) != 0,
+					Loc:  token.Loc,
+				})
+				return true
+			},
+		},
+		"<": {
+			Description: "Check if `a` is less than `b`$SPOILER$. Works for Timestamps, Strings (lexicographically), Numbers and Bools.",
+			Category:    "Conditionals",
+			Signature:   Signature{
+				Ins:  []Param{typeVar("a", "Type", ComparableKinds...), typeVar("b", "Type", ComparableKinds...)},
+				Outs: []Param{param("result", TokenBool)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				context.argsStack = append(context.argsStack, Token{
+					Kind: TokenBool,
+					Bool: compareValues(args[1], args[0]) < 0,
+					Loc:  token.Loc,
+				})
+				return true
+			},
+		},
+		"<=": {
+			Description: "Check if `a` is less than or equal to `b`$SPOILER$. Works for Timestamps, Strings (lexicographically), Numbers and Bools.",
+			Category:    "Conditionals",
+			Signature:   Signature{
+				Ins:  []Param{typeVar("a", "Type", ComparableKinds...), typeVar("b", "Type", ComparableKinds...)},
+				Outs: []Param{param("result", TokenBool)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				context.argsStack = append(context.argsStack, Token{
+					Kind: TokenBool,
+					Bool: compareValues(args[1], args[0]) <= 0,
+					Loc:  token.Loc,
+				})
+				return true
+			},
+		},
+		">": {
+			Description: "Check if `a` is greater than `b`$SPOILER$. Works for Timestamps, Strings (lexicographically), Numbers and Bools.",
+			Category:    "Conditionals",
+			Signature:   Signature{
+				Ins:  []Param{typeVar("a", "Type", ComparableKinds...), typeVar("b", "Type", ComparableKinds...)},
+				Outs: []Param{param("result", TokenBool)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				context.argsStack = append(context.argsStack, Token{
+					Kind: TokenBool,
+					Bool: compareValues(args[1], args[0]) > 0,
+					Loc:  token.Loc,
+				})
+				return true
+			},
+		},
+		">=": {
+			Description: "Check if `a` is greater than or equal to `b`$SPOILER$. Works for Timestamps, Strings (lexicographically), Numbers and Bools.",
+			Category:    "Conditionals",
+			Signature:   Signature{
+				Ins:  []Param{typeVar("a", "Type", ComparableKinds...), typeVar("b", "Type", ComparableKinds...)},
+				Outs: []Param{param("result", TokenBool)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				context.argsStack = append(context.argsStack, Token{
+					Kind: TokenBool,
+					Bool: compareValues(args[1], args[0]) >= 0,
+					Loc:  token.Loc,
+				})
+				return true
+			},
+		},
+		"if": {
+			Description: "Evaluate the `then` block only if `cond` is true$SPOILER$. For example `input_path \"stream.mp4\" = { \"-vf drawtext=text=tsoding\" outf } if`.",
+			Category:    "Conditionals",
+			Signature:   Signature{
+				Ins: []Param{param("cond", TokenBool), param("then", TokenBlock)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				then := args[0]
+				cond := args[1]
+				if cond.Bool {
+					if !context.callBlock(token.Loc, then.Block) {
+						Diags.Note(token.Loc, "in the body of %s", command)
+						return false
+					}
+				}
+				return true
+			},
+		},
+		"if_else": {
+			Description: "Evaluate the `then` block if `cond` is true, otherwise evaluate the `else` block.",
+			Category:    "Conditionals",
+			Signature:   Signature{
+				Ins: []Param{param("cond", TokenBool), param("then", TokenBlock), param("else", TokenBlock)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				body := args[0]
+				if args[2].Bool {
+					body = args[1]
+				}
+				if !context.callBlock(token.Loc, body.Block) {
+					Diags.Note(token.Loc, "in the body of %s", command)
+					return false
+				}
+				return true
+			},
+		},
+		"input_path": {
+			Description: "Path to the current input set by the `input` func$SPOILER$. Empty string if no input was set yet.",
+			Category:    "Misc",
+			Signature:   Signature{
+				Outs: []Param{param("path", TokenString)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				context.argsStack = append(context.argsStack, Token{
+					Kind: TokenString,
+					Text: []rune(context.inputPath),
+					Loc:  token.Loc,
+				})
+				return true
+			},
+		},
+		"matches": {
+			Description: "Check if the string `s` matches the regular expression `regexp`$SPOILER$. Uses the syntax of https://pkg.go.dev/regexp/syntax. The match is not anchored, use `^` and `$` for that.",
+			Category:    "Conditionals",
+			Signature:   Signature{
+				Ins:  []Param{param("s", TokenString), param("regexp", TokenString)},
+				Outs: []Param{param("result", TokenBool)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				re, err := regexp.Compile(string(args[0].Text))
+				if err != nil {
+					Diags.Error(args[0].Loc, "invalid regular expression: %s", err)
+					return false
+				}
+				context.argsStack = append(context.argsStack, Token{
+					Kind: TokenBool,
+					Bool: re.MatchString(string(args[1].Text)),
+					Loc:  token.Loc,
+				})
+				return true
+			},
+		},
+		"seconds": {
+			Description: "Convert a number of seconds to a timestamp$SPOILER$. For example `#1.5 seconds` is the same as `0:00:01.500`.",
+			Category:    "Numbers",
+			Signature:   Signature{
+				Ins:  []Param{param("secs", TokenNumber)},
+				Outs: []Param{param("timestamp", TokenTimestamp)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				context.argsStack = append(context.argsStack, Token{
+					Kind:      TokenTimestamp,
+					Timestamp: Millis(math.Round(args[0].Number * 1000)),
+					Loc:       token.Loc,
+				})
+				return true
+			},
+		},
+		"to_seconds": {
+			Description: "Convert a timestamp to a number of seconds$SPOILER$. For example `0:01:30.500 to_seconds` is the same as `#90.5`.",
+			Category:    "Numbers",
+			Signature:   Signature{
+				Ins:  []Param{param("timestamp", TokenTimestamp)},
+				Outs: []Param{param("secs", TokenNumber)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				context.argsStack = append(context.argsStack, Token{
+					Kind:   TokenNumber,
+					Number: float64(args[0].Timestamp) / 1000,
+					Loc:    token.Loc,
+				})
+				return true
+			},
+		},
+		"min": {
+			Description: "The smaller of two timestamps or numbers.",
+			Category:    "Numbers",
+			Signature:   Signature{
+				Ins:  []Param{typeVar("a", "T", TokenTimestamp, TokenNumber), typeVar("b", "T", TokenTimestamp, TokenNumber)},
+				Outs: []Param{typeVar("result", "T", TokenTimestamp, TokenNumber)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				context.argsStack = append(context.argsStack, Token{
+					Kind:      args[0].Kind,
+					Timestamp: min(args[1].Timestamp, args[0].Timestamp),
+					Number:    min(args[1].Number, args[0].Number),
+					Loc:       token.Loc,
+				})
+				return true
+			},
+		},
+		"max": {
+			Description: "The bigger of two timestamps or numbers.",
+			Category:    "Numbers",
+			Signature:   Signature{
+				Ins:  []Param{typeVar("a", "T", TokenTimestamp, TokenNumber), typeVar("b", "T", TokenTimestamp, TokenNumber)},
+				Outs: []Param{typeVar("result", "T", TokenTimestamp, TokenNumber)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				context.argsStack = append(context.argsStack, Token{
+					Kind:      args[0].Kind,
+					Timestamp: max(args[1].Timestamp, args[0].Timestamp),
+					Number:    max(args[1].Number, args[0].Number),
+					Loc:       token.Loc,
+				})
+				return true
+			},
+		},
+		"abs": {
+			Description: "Absolute value of a timestamp or a number.",
+			Category:    "Numbers",
+			Signature:   Signature{
+				Ins:  []Param{typeVar("a", "T", TokenTimestamp, TokenNumber)},
+				Outs: []Param{typeVar("|a|", "T", TokenTimestamp, TokenNumber)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				context.argsStack = append(context.argsStack, Token{
+					Kind:      args[0].Kind,
+					Timestamp: max(args[0].Timestamp, -args[0].Timestamp),
+					Number:    math.Abs(args[0].Number),
+					Loc:       token.Loc,
+				})
+				return true
+			},
+		},
+		"let": {
+			Description: "Bind a value to a name$SPOILER$ so it is pushed back onto the stack every time the name is used. For example `0:12:34 \"intro_end\" let` ... `intro_end 0:20:00 chunk`. The variables are shared between the MARKUT file, $HOME/.markut and all the included files. A variable can be rebound with another `let`.",
+			Category:    "Variables",
+			Signature:   Signature{
+				Ins: []Param{typeVar("value", "Type"), param("name", TokenString)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				return context.bindVariable(args, false)
+			},
+		},
+		"const": {
+			Description: "Same as `let` but the name cannot be rebound later.",
+			Category:    "Variables",
+			Signature:   Signature{
+				Ins: []Param{typeVar("value", "Type"), param("name", TokenString)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				return context.bindVariable(args, true)
+			},
+		},
+		"defined": {
+			Description: "Check if there is a variable or a word with the name `name`$SPOILER$. Useful for providing default values for the settings that may or may not be exported by $HOME/.markut or the included files.",
+			Category:    "Variables",
+			Signature:   Signature{
+				Ins:  []Param{param("name", TokenString)},
+				Outs: []Param{param("result", TokenBool)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				name := string(args[0].Text)
+				_, isVar := context.vars[name]
+				_, isWord := context.words[name]
+				context.argsStack = append(context.argsStack, Token{
+					Kind: TokenBool,
+					Bool: isVar || isWord,
+					Loc:  token.Loc,
+				})
+				return true
+			},
+		},
+		"fps": {
+			Description: "Set the frame rate$SPOILER$ used for converting frame counts like `1234f` and SMPTE timecode like `00:12:34:05` to timestamps. For example `#30 fps` or `#29.97 fps`.",
 			Category:    "Misc",
-			Signature:   "<a:String> <b:String> -- <a++b:String>",
-			Run: func(context *EvalContext, command string, token Token) bool {
-				args, err := context.typeCheckArgs(token.Loc, TokenString, TokenString)
+			Signature:   Signature{
+				Ins: []Param{param("fps", TokenNumber)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				fps := args[0]
+				if fps.Number <= 0 {
+					Diags.Error(fps.Loc, "the frame rate must be positive but got %g", fps.Number)
+					return false
+				}
+				context.fps = fps.Number
+				context.fpsLoc = fps.Loc
+				return true
+			},
+		},
+		"format": {
+			Description: "Format the values of the list according to the printf-style `template`.$SPOILER$ For example `[ #2 \"Lexer\" ] \"Part %d - %s\" format`. %s and %v accept any value and render timestamps as HH:MM:SS.mmm. %d accepts integer numbers and timestamps in milliseconds. %f, %e and %g accept numbers. %% is the percent sign.",
+			Category:    "Strings",
+			Signature:   Signature{
+				Ins:  []Param{param("values", TokenList), param("template", TokenString)},
+				Outs: []Param{param("result", TokenString)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				template := args[0]
+				result, err := formatTokens(string(template.Text), args[1].List)
 				if err != nil {
-					fmt.Printf("%s: ERROR: type check failed for %s\n", token.Loc, command)
-					fmt.Printf("%s\n", err)
+					Diags.Error(template.Loc, "%s", err)
 					return false
 				}
+				context.argsStack = append(context.argsStack, Token{
+					Kind: TokenString,
+					Text: []rune(result),
+					Loc:  token.Loc,
+				})
+				return true
+			},
+		},
+		"to_string": {
+			Description: "Convert a timestamp, number or boolean to a string.$SPOILER$ Timestamps are rendered as HH:MM:SS.mmm. Strings are left as they are.",
+			Category:    "Strings",
+			Signature:   Signature{
+				Ins:  []Param{param("value", ComparableKinds...)},
+				Outs: []Param{param("result", TokenString)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				context.argsStack = append(context.argsStack, Token{
+					Kind: TokenString,
+					Text: []rune(tokenToString(args[0])),
+					Loc:  token.Loc,
+				})
+				return true
+			},
+		},
+		"replace": {
+			Description: "Replace all the occurrences of `old` in `s` with `new`.",
+			Category:    "Strings",
+			Signature:   Signature{
+				Ins:  []Param{param("s", TokenString), param("old", TokenString), param("new", TokenString)},
+				Outs: []Param{param("result", TokenString)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				context.argsStack = append(context.argsStack, Token{
+					Kind: TokenString,
+					Text: []rune(strings.ReplaceAll(string(args[2].Text), string(args[1].Text), string(args[0].Text))),
+					Loc:  token.Loc,
+				})
+				return true
+			},
+		},
+		"split": {
+			Description: "Split `s` into a list of strings separated by `sep`.$SPOILER$ An empty `sep` splits the string into separate characters.",
+			Category:    "Strings",
+			Signature:   Signature{
+				Ins:  []Param{param("s", TokenString), param("sep", TokenString)},
+				Outs: []Param{param("parts", TokenList)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				list := Token{
+					Kind: TokenList,
+					Text: []rune("["),
+					Loc:  token.Loc,
+				}
+				for _, part := range strings.Split(string(args[1].Text), string(args[0].Text)) {
+					list.List = append(list.List, Token{
+						Kind: TokenString,
+						Text: []rune(part),
+						Loc:  token.Loc,
+					})
+				}
+				context.argsStack = append(context.argsStack, list)
+				return true
+			},
+		},
+		"upper": {
+			Description: "Convert the string to upper case.",
+			Category:    "Strings",
+			Signature:   Signature{
+				Ins:  []Param{param("s", TokenString)},
+				Outs: []Param{param("result", TokenString)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				context.argsStack = append(context.argsStack, Token{
+					Kind: TokenString,
+					Text: []rune(strings.ToUpper(string(args[0].Text))),
+					Loc:  token.Loc,
+				})
+				return true
+			},
+		},
+		"lower": {
+			Description: "Convert the string to lower case.",
+			Category:    "Strings",
+			Signature:   Signature{
+				Ins:  []Param{param("s", TokenString)},
+				Outs: []Param{param("result", TokenString)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
+				context.argsStack = append(context.argsStack, Token{
+					Kind: TokenString,
+					Text: []rune(strings.ToLower(string(args[0].Text))),
+					Loc:  token.Loc,
+				})
+				return true
+			},
+		},
+		"concat": {
+			Description: "Concatenate two strings.",
+			Category:    "Strings",
+			Signature:   Signature{
+				Ins:  []Param{param("a", TokenString), param("b", TokenString)},
+				Outs: []Param{param("a++b", TokenString)},
+			},
+			Run: func(context *EvalContext, command string, token Token, args []Token) bool {
 				context.argsStack = append(context.argsStack, Token{
 					Kind: TokenString,
 					Text: slices.Concat(args[1].Text, args[0].Text),
@@ -2003,18 +4028,40 @@ func main() {
 			},
 		},
 	}
+}
+
+func main() {
+	// The diagnostic flags provided before the subcommand
+	args, err := Diags.ParseFlags(flag.NewFlagSet("markut", flag.ContinueOnError), os.Args[1:])
+	if err != nil {
+		usage()
+		Diags.Error(Loc{}, "%s", err)
+		exit(1)
+	}
+	if len(args) < 1 {
+		usage()
+		Diags.Error(Loc{}, "No subcommand is provided")
+		exit(1)
+	}
 
-	name := os.Args[1]
-	args := os.Args[2:]
+	name := args[0]
+	args = args[1:]
 	subcommand, ok := Subcommands[name]
 	if !ok {
 		usage()
-		fmt.Printf("ERROR: Unknown subcommand %s\n", name)
-		os.Exit(1)
+		Diags.Error(Loc{}, "Unknown subcommand %s", name)
+		exit(1)
 	}
 	if !subcommand.Run(name, args) {
-		os.Exit(1)
+		exit(1)
 	}
+	exit(0)
+}
+
+// Makes sure the pending diagnostics are not lost on exit
+func exit(code int) {
+	Diags.Flush()
+	os.Exit(code)
 }
 
 // TODO: Consider rewritting Markut in C with nob.h
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestDisplayValue(t *testing.T) {
+	cases := []struct {
+		value    Token
+		expected string
+	}{
+		{value: Token{Kind: TokenNumber, Number: 10000000}, expected: "#10000000"},
+		{value: Token{Kind: TokenNumber, Number: -0.25}, expected: "#-0.25"},
+		{value: Token{Kind: TokenTimestamp, Timestamp: 90 * 1000}, expected: "00:01:30.000"},
+		{value: Token{Kind: TokenString, Text: []rune("a\"b")}, expected: "\"a\\\"b\""},
+		{value: Token{Kind: TokenList, List: []Token{{Kind: TokenNumber, Number: 1}, {Kind: TokenBool, Bool: true}}}, expected: "[ #1 true ]"},
+	}
+	for _, c := range cases {
+		if actual := displayValue(c.value); actual != c.expected {
+			t.Errorf("expected %s but got %s", c.expected, actual)
+		}
+	}
+}
+
+func evalTestMarkut(content string) (EvalContext, bool) {
+	context := EvalContext{
+		outputPath: "output.mp4",
+	}
+	ok := context.evalMarkutContent(content, "test.markut")
+	ok = context.finishEval() && ok
+	return context, ok
+}
+
+func TestEvalRecoversFromErrors(t *testing.T) {
+	cases := []struct {
+		content string
+		chunks  int
+	}{
+		{content: "2:00 1:00 chunk 3:00 4:00 chunk", chunks: 1},
+		{content: "\"a\" 1:00 chunk 3:00 4:00 chunk", chunks: 1},
+		{content: "oops 1:00 2:00 chunk oops 3:00 4:00 chunk", chunks: 2},
+		{content: "1:00 2:00 chunk 1:10 + 3:00 4:00 chunk", chunks: 2},
+		{content: "[ 1:00 2:00 ] { oops } each 3:00 4:00 chunk", chunks: 1},
+		{content: "\"a\" #2 * 1:00 + 3:00 4:00 chunk", chunks: 1},
+		{content: "1:00 #0 / 3:00 4:00 chunk", chunks: 1},
+		{content: "{ oops } \"bad\" define bad 1:00 2:00 chunk", chunks: 1},
+		{content: "1:00 [ drop ] 1:00 2:00 chunk", chunks: 1},
+	}
+	for _, c := range cases {
+		context, ok := evalTestMarkut(c.content)
+		if ok {
+			t.Errorf("%s: expected the evaluation to fail", c.content)
+		}
+		if len(context.chunks) != c.chunks {
+			t.Errorf("%s: expected %d chunks but got %d", c.content, c.chunks, len(context.chunks))
+		}
+		for _, value := range context.argsStack {
+			if !value.Poisoned {
+				t.Errorf("%s: expected the stack to be resynchronized but %s is left on it", c.content, displayValue(value))
+			}
+		}
+	}
+}
+
+// Writes the files into a temporary folder and returns the path of the folder
+func writeTestFiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		filePath := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestEvalIncludes(t *testing.T) {
+	cases := []struct {
+		name   string
+		files  map[string]string
+		ok     bool
+		chunks int
+	}{
+		{
+			name: "relative to the including file",
+			files: map[string]string{
+				"MARKUT":       "\"sub/a.markut\" include",
+				"sub/a.markut": "\"b.markut\" include",
+				"sub/b.markut": "1:00 2:00 chunk",
+			},
+			ok:     true,
+			chunks: 1,
+		},
+		{
+			name: "include cycle",
+			files: map[string]string{
+				"MARKUT":   "\"a.markut\" include 3:00 4:00 chunk",
+				"a.markut": "1:00 2:00 chunk \"b.markut\" include",
+				"b.markut": "\"a.markut\" include",
+			},
+			ok:     false,
+			chunks: 2,
+		},
+		{
+			name: "file including itself",
+			files: map[string]string{
+				"MARKUT": "1:00 2:00 chunk \"MARKUT\" include",
+			},
+			ok:     false,
+			chunks: 1,
+		},
+		{
+			name: "include twice",
+			files: map[string]string{
+				"MARKUT":   "\"a.markut\" include \"a.markut\" include",
+				"a.markut": "1:00 2:00 chunk",
+			},
+			ok:     true,
+			chunks: 2,
+		},
+		{
+			name: "include_once after include",
+			files: map[string]string{
+				"MARKUT":   "\"a.markut\" include \"./a.markut\" include_once",
+				"a.markut": "1:00 2:00 chunk",
+			},
+			ok:     true,
+			chunks: 1,
+		},
+		{
+			name: "include_once of the file being included",
+			files: map[string]string{
+				"MARKUT":   "\"a.markut\" include",
+				"a.markut": "1:00 2:00 chunk \"a.markut\" include_once",
+			},
+			ok:     true,
+			chunks: 1,
+		},
+		{
+			name: "include_path",
+			files: map[string]string{
+				"MARKUT":       "\"lib\" include_path \"a.markut\" include",
+				"lib/a.markut": "1:00 2:00 chunk",
+			},
+			ok:     true,
+			chunks: 1,
+		},
+		{
+			name: "next to the including file before include_path",
+			files: map[string]string{
+				"MARKUT":       "\"lib\" include_path \"a.markut\" include",
+				"a.markut":     "1:00 2:00 chunk",
+				"lib/a.markut": "1:00 2:00 chunk 3:00 4:00 chunk",
+			},
+			ok:     true,
+			chunks: 1,
+		},
+		{
+			name: "include_if_exists of a missing file",
+			files: map[string]string{
+				"MARKUT": "\"a.markut\" include_if_exists 1:00 2:00 chunk",
+			},
+			ok:     true,
+			chunks: 1,
+		},
+	}
+	for _, c := range cases {
+		dir := writeTestFiles(t, c.files)
+		context := EvalContext{
+			outputPath: "output.mp4",
+		}
+		ok := context.evalMarkutFile(nil, filepath.Join(dir, "MARKUT"), false)
+		ok = context.finishEval() && ok
+		if ok != c.ok {
+			t.Errorf("%s: expected the evaluation to succeed: %t, but got %t", c.name, c.ok, ok)
+		}
+		if len(context.chunks) != c.chunks {
+			t.Errorf("%s: expected %d chunks but got %d", c.name, c.chunks, len(context.chunks))
+		}
+	}
+}
+
+func TestEvalPaths(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"a.mp4":    "",
+		"b.mp4":    "",
+		"c.markut": "",
+	})
+	cases := []struct {
+		content  string
+		expected string
+	}{
+		{content: "\"a.mp4\" file_exists", expected: "true"},
+		{content: "\"x.mp4\" file_exists", expected: "false"},
+		{content: "\"*.mp4\" glob", expected: "[ \"a.mp4\" \"b.mp4\" ]"},
+		{content: "\"videos/a.mp4\" basename", expected: "\"a.mp4\""},
+		{content: "\"videos/a.mp4\" dirname", expected: "\"videos\""},
+		{content: "\"videos\" \"a.mp4\" path_join", expected: "\"videos/a.mp4\""},
+	}
+	for _, c := range cases {
+		// The relative paths are resolved against baseDir the same way the
+		// LSP server does it
+		context := EvalContext{
+			outputPath: "output.mp4",
+			baseDir:    dir,
+		}
+		expectTestValue(t, context, c.content, c.expected)
+	}
+}
+
+// Evaluates the content expecting it to leave a single value on the stack
+func expectTestValue(t *testing.T, context EvalContext, content string, expected string) {
+	t.Helper()
+	if !context.evalMarkutContent(content, "test.markut") {
+		t.Errorf("%s: expected the evaluation to succeed", content)
+		return
+	}
+	if len(context.argsStack) != 1 {
+		t.Errorf("%s: expected a single value on the stack but got %d", content, len(context.argsStack))
+		return
+	}
+	if actual := displayValue(context.argsStack[0]); actual != expected {
+		t.Errorf("%s: expected %s but got %s", content, expected, actual)
+	}
+}
+
+func TestFormatTokens(t *testing.T) {
+	number := func(n float64) Token { return Token{Kind: TokenNumber, Number: n} }
+	str := func(s string) Token { return Token{Kind: TokenString, Text: []rune(s)} }
+	timestamp := Token{Kind: TokenTimestamp, Timestamp: 90500}
+	cases := []struct {
+		template string
+		values   []Token
+		expected string
+	}{
+		{template: "Part %d - %s", values: []Token{number(2), str("Lexer")}, expected: "Part 2 - Lexer"},
+		{template: "%s", values: []Token{timestamp}, expected: "00:01:30.500"},
+		{template: "%v", values: []Token{number(0.25)}, expected: "0.25"},
+		{template: "%d ms", values: []Token{timestamp}, expected: "90500 ms"},
+		{template: "%03d", values: []Token{number(7)}, expected: "007"},
+		{template: "%.2f", values: []Token{number(1.0 / 3)}, expected: "0.33"},
+		{template: "%-5s|", values: []Token{str("ab")}, expected: "ab   |"},
+		{template: "100%%", values: nil, expected: "100%"},
+		{template: "%v", values: []Token{{Kind: TokenBool, Bool: true}}, expected: "true"},
+	}
+	for _, c := range cases {
+		actual, err := formatTokens(c.template, c.values)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", c.template, err)
+			continue
+		}
+		if actual != c.expected {
+			t.Errorf("%s: expected %q but got %q", c.template, c.expected, actual)
+		}
+	}
+}
+
+func TestFormatTokensErrors(t *testing.T) {
+	cases := []struct {
+		template string
+		values   []Token
+	}{
+		{template: "%d", values: []Token{{Kind: TokenNumber, Number: 2.5}}},
+		{template: "%d", values: []Token{{Kind: TokenString, Text: []rune("a")}}},
+		{template: "%f", values: []Token{{Kind: TokenTimestamp, Timestamp: 1000}}},
+		{template: "%s %s", values: []Token{{Kind: TokenString, Text: []rune("a")}}},
+		{template: "%s", values: nil},
+		{template: "", values: []Token{{Kind: TokenString, Text: []rune("a")}}},
+		{template: "%q", values: []Token{{Kind: TokenString, Text: []rune("a")}}},
+		{template: "50%", values: nil},
+	}
+	for _, c := range cases {
+		if actual, err := formatTokens(c.template, c.values); err == nil {
+			t.Errorf("%s: expected an error but got %q", c.template, actual)
+		}
+	}
+}
+
+func TestEvalStrings(t *testing.T) {
+	cases := []struct {
+		content  string
+		expected string
+	}{
+		{content: "[ #2 \"Lexer\" ] \"Part %d - %s\" format", expected: "\"Part 2 - Lexer\""},
+		{content: "[ 1:30 ] \"at %s\" format", expected: "\"at 00:01:30.000\""},
+		{content: "#1.5 to_string", expected: "\"1.5\""},
+		{content: "\"a-b-c\" \"-\" split", expected: "[ \"a\" \"b\" \"c\" ]"},
+		{content: "\"abc\" \"\" split", expected: "[ \"a\" \"b\" \"c\" ]"},
+		{content: "\"a,b\" \";\" split", expected: "[ \"a,b\" ]"},
+		{content: "\"a-b-c\" \"-\" \"+\" replace", expected: "\"a+b+c\""},
+		{content: "\"a-b-c\" \"x\" \"+\" replace", expected: "\"a-b-c\""},
+		{content: "\"a-b\" \"-\" \"\" replace", expected: "\"ab\""},
+		{content: "\"Lexer\" upper", expected: "\"LEXER\""},
+		{content: "\"Lexer\" lower", expected: "\"lexer\""},
+		{content: "\"héllo\" length", expected: "#5"},
+		{content: "[ #1 #2 ] length", expected: "#2"},
+	}
+	for _, c := range cases {
+		expectTestValue(t, EvalContext{outputPath: "output.mp4"}, c.content, c.expected)
+	}
+}
+
+func TestSpeedTiming(t *testing.T) {
+	cases := []struct {
+		content   string
+		durations []Millis
+		chapters  []Millis
+	}{
+		{
+			content:   "0:00 1:00 chunk #2 speed",
+			durations: []Millis{30000},
+		},
+		{
+			content:   "0:00 \"A\" chapter 0:00 1:00 chunk #2 speed 2:00 \"B\" chapter 2:00 3:00 chunk",
+			durations: []Millis{30000, 60000},
+			chapters:  []Millis{0, 30000},
+		},
+		{
+			content:   "0:00 \"A\" chapter 0:40 \"B\" chapter 0:00 1:00 chunk #2 speed 2:00 \"C\" chapter 2:00 3:00 chunk #0.5 speed",
+			durations: []Millis{30000, 120000},
+			chapters:  []Millis{0, 20000, 30000},
+		},
+		{
+			// The transition lasts 2 seconds in the final video which is 4
+			// seconds of the first chunk and 1 second of the second one
+			content:   "0:00 1:00 chunk #2 speed \"crossfade\" 0:02 transition 2:00 3:00 chunk #0.5 speed",
+			durations: []Millis{28000, 2000, 118000},
+		},
+	}
+	for _, c := range cases {
+		context, ok := evalTestMarkut(c.content)
+		if !ok {
+			t.Errorf("%s: expected the evaluation to succeed", c.content)
+			continue
+		}
+		durations := []Millis{}
+		for _, chunk := range context.renderChunks() {
+			durations = append(durations, chunk.OutputDuration())
+		}
+		if !slices.Equal(durations, c.durations) {
+			t.Errorf("%s: expected the rendered chunks of durations %v but got %v", c.content, c.durations, durations)
+		}
+		chapters := []Millis{}
+		for _, chapter := range context.chapters {
+			chapters = append(chapters, chapter.Timestamp)
+		}
+		if len(c.chapters) > 0 && !slices.Equal(chapters, c.chapters) {
+			t.Errorf("%s: expected the chapters at %v but got %v", c.content, c.chapters, chapters)
+		}
+	}
+}
+
+func TestSpeedErrors(t *testing.T) {
+	cases := []string{
+		"#2 speed 0:00 1:00 chunk",
+		"0:00 1:00 chunk #0 speed",
+		"0:00 1:00 chunk #-2 speed",
+		"0:00 1:00 chunk \"crossfade\" 0:01 transition #2 speed 2:00 3:00 chunk",
+		"0:00 0:10 chunk 0:08 false fade_in #2 speed",
+	}
+	for _, content := range cases {
+		if _, ok := evalTestMarkut(content); ok {
+			t.Errorf("%s: expected the evaluation to fail", content)
+		}
+	}
+}
+
+func TestSpeedAudioFilter(t *testing.T) {
+	cases := []struct {
+		speed    float64
+		expected string
+	}{
+		{speed: 0, expected: ""},
+		{speed: 1.5, expected: "atempo=1.5"},
+		{speed: 8, expected: "atempo=2,atempo=2,atempo=2"},
+		{speed: 0.2, expected: "atempo=0.5,atempo=0.5,atempo=0.8"},
+	}
+	for _, c := range cases {
+		if actual := chunkAudioFilter(Chunk{Start: 0, End: 60000, Speed: c.speed}); actual != c.expected {
+			t.Errorf("%g: expected %q but got %q", c.speed, c.expected, actual)
+		}
+	}
+}
+
+func TestCutChunks(t *testing.T) {
+	cases := []struct {
+		content string
+		// Start and end of each chunk of the cut
+		ranges [][2]Millis
+		// The audio filters of the chunks of the cut
+		filters []string
+	}{
+		{
+			content: "0:00 1:00 chunk 0:10 cut 2:00 3:00 chunk",
+			ranges:  [][2]Millis{{50000, 60000}, {120000, 130000}},
+			filters: []string{"", ""},
+		},
+		{
+			content: "0:00 1:00 chunk #2 speed 0:10 cut 2:00 3:00 chunk",
+			ranges:  [][2]Millis{{40000, 60000}, {120000, 130000}},
+			filters: []string{"atempo=2", ""},
+		},
+		{
+			content: "0:00 1:00 chunk \"crossfade\" 0:02 transition 0:10 cut 2:00 3:00 chunk",
+			ranges:  [][2]Millis{{50000, 58000}, {0, 2000}, {122000, 130000}},
+			filters: []string{"", "", ""},
+		},
+		{
+			// The cut starts before any chunks, so it starts at the beginning
+			// of the final video
+			content: "0:05 cut_start 0:00 1:00 chunk 0:10 cut_end 2:00 3:00 chunk",
+			ranges:  [][2]Millis{{0, 60000}, {120000, 130000}},
+			filters: []string{"", ""},
+		},
+		{
+			// The fades on the trimmed side of the chunks are dropped
+			content: "0:00 1:00 chunk 0:02 false fade_in 0:02 false fade_out 0:10 cut 2:00 3:00 chunk 0:02 false fade_in 0:02 false fade_out",
+			ranges:  [][2]Millis{{50000, 60000}, {120000, 130000}},
+			filters: []string{"afade=t=out:st=8.000:d=2.000", "afade=t=in:st=0:d=2.000"},
+		},
+		{
+			// The ranged effects stay at the same place of the input
+			content: "0:00 1:00 chunk 0:55 0:58 mute_range 0:10 cut 2:00 3:00 chunk",
+			ranges:  [][2]Millis{{50000, 60000}, {120000, 130000}},
+			filters: []string{"volume=0:enable='between(t,5.000,8.000)'", ""},
+		},
+	}
+	for _, c := range cases {
+		context, ok := evalTestMarkut(c.content)
+		if !ok {
+			t.Errorf("%s: expected the evaluation to succeed", c.content)
+			continue
+		}
+		if len(context.cuts) != 1 {
+			t.Errorf("%s: expected a single cut but got %d", c.content, len(context.cuts))
+			continue
+		}
+		ranges := [][2]Millis{}
+		filters := []string{}
+		for _, chunk := range context.cutChunks(context.cuts[0]) {
+			ranges = append(ranges, [2]Millis{chunk.Start, chunk.End})
+			filters = append(filters, chunkAudioFilter(chunk))
+		}
+		if !slices.Equal(ranges, c.ranges) {
+			t.Errorf("%s: expected the chunks %v but got %v", c.content, c.ranges, ranges)
+		}
+		if !slices.Equal(filters, c.filters) {
+			t.Errorf("%s: expected the audio filters %q but got %q", c.content, c.filters, filters)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+type NodeKind int
+
+const (
+	// Any single token that is not a part of the structure of the syntax
+	// tree: literals, symbols, arithmetic operators etc.
+	NodeToken NodeKind = iota
+	// { ... }
+	NodeBlock
+	// [ ... ]
+	NodeList
+	NodeComment
+)
+
+type Node struct {
+	Kind NodeKind
+	// The token itself for NodeToken and NodeComment. The opening bracket for
+	// NodeBlock and NodeList.
+	Token    Token
+	Children []Node
+	// Location of the closing bracket for NodeBlock and NodeList
+	CloseLoc Loc
+	// Location right after the last character of the node
+	End Loc
+}
+
+// `include`, `include_if_exists` or `include_once` of a file with the path
+// known at parse time, i.e. provided as a string literal right before the func
+type Include struct {
+	Loc      Loc
+	Path     string
+	IfExists bool
+	// nil if the file could not be read
+	File *File
+	Err  error
+}
+
+type File struct {
+	Path     string
+	Nodes    []Node
+	Errors   []error
+	Includes []Include
+	// Folders added by `include_path` with the paths known at parse time.
+	// Relative folders are resolved against the folder of the file.
+	IncludePath []string
+}
+
+type Parser struct {
+	Lexer  *Lexer
+	Errors []error
+}
+
+var ClosingKinds = map[TokenKind]TokenKind{
+	TokenCurlyOpen:   TokenCurlyClose,
+	TokenBracketOpen: TokenBracketClose,
+}
+
+// Parses the nodes until the EOF or the closing bracket that matches the
+// `open` one. The closing bracket is returned as `close`.
+func (parser *Parser) parseNodes(open *Token) (nodes []Node, close *SpannedToken) {
+	for {
+		token, err := parser.Lexer.ChopToken()
+		if err != nil {
+			parser.Errors = append(parser.Errors, err)
+			// Recovering by skipping the rest of the broken token
+			parser.Lexer.SkipUntilSpace()
+			continue
+		}
+		end := parser.Lexer.Loc()
+
+		switch token.Kind {
+		case TokenEOF:
+			if open != nil {
+				parser.Errors = append(parser.Errors, &DiagErr{
+					Loc: open.Loc,
+					Err: fmt.Errorf("Unclosed %s. Expected %s before the %s", TokenKindName[open.Kind], TokenKindName[ClosingKinds[open.Kind]], TokenKindName[TokenEOF]),
+				})
+			}
+			return
+		case TokenCurlyOpen, TokenBracketOpen:
+			node := Node{
+				Kind:  NodeBlock,
+				Token: token,
+				End:   end,
+			}
+			if token.Kind == TokenBracketOpen {
+				node.Kind = NodeList
+			}
+			var close *SpannedToken
+			node.Children, close = parser.parseNodes(&token)
+			if close != nil {
+				node.CloseLoc = close.Token.Loc
+				node.End = close.End
+			}
+			nodes = append(nodes, node)
+		case TokenCurlyClose, TokenBracketClose:
+			if open != nil && ClosingKinds[open.Kind] == token.Kind {
+				close = &SpannedToken{
+					Token: token,
+					End:   end,
+				}
+				return
+			}
+			if open != nil {
+				parser.Errors = append(parser.Errors, &DiagErr{
+					Loc: token.Loc,
+					Err: fmt.Errorf("Expected %s but got %s", TokenKindName[ClosingKinds[open.Kind]], TokenKindName[token.Kind]),
+				})
+			} else {
+				parser.Errors = append(parser.Errors, &DiagErr{
+					Loc: token.Loc,
+					Err: fmt.Errorf("Unexpected %s without the matching opening one", TokenKindName[token.Kind]),
+				})
+			}
+		case TokenComment:
+			nodes = append(nodes, Node{
+				Kind:  NodeComment,
+				Token: token,
+				End:   end,
+			})
+		default:
+			nodes = append(nodes, Node{
+				Kind:  NodeToken,
+				Token: token,
+				End:   end,
+			})
+		}
+	}
+}
+
+// Parses the whole content of the lexer. Never fails, all the syntax errors
+// are collected into File.Errors and the parser recovers from them as much as
+// it can.
+func ParseLexer(lexer *Lexer) *File {
+	lexer.KeepComments = true
+	parser := Parser{Lexer: lexer}
+	nodes, _ := parser.parseNodes(nil)
+	file := &File{
+		Path:   lexer.FilePath,
+		Nodes:  nodes,
+		Errors: parser.Errors,
+	}
+	file.findIncludes(file.Nodes)
+	return file
+}
+
+func ParseMarkutContent(content string, path string) *File {
+	lexer := NewLexer(content, path)
+	return ParseLexer(&lexer)
+}
+
+// Skips the comments
+func significantNodes(nodes []Node) (result []Node) {
+	for _, node := range nodes {
+		if node.Kind != NodeComment {
+			result = append(result, node)
+		}
+	}
+	return
+}
+
+func (file *File) findIncludes(nodes []Node) {
+	nodes = significantNodes(nodes)
+	for i, node := range nodes {
+		if node.Kind == NodeBlock || node.Kind == NodeList {
+			file.findIncludes(node.Children)
+			continue
+		}
+		if node.Token.Kind != TokenString || i+1 >= len(nodes) {
+			continue
+		}
+		next := nodes[i+1]
+		if next.Kind != NodeToken || next.Token.Kind != TokenSymbol {
+			continue
+		}
+		switch string(next.Token.Text) {
+		case "include", "include_if_exists", "include_once":
+			file.Includes = append(file.Includes, Include{
+				Loc:      node.Token.Loc,
+				Path:     string(node.Token.Text),
+				IfExists: string(next.Token.Text) == "include_if_exists",
+			})
+		case "include_path":
+			dir := string(node.Token.Text)
+			if !filepath.IsAbs(dir) {
+				dir = filepath.Join(filepath.Dir(file.Path), dir)
+			}
+			if !slices.Contains(file.IncludePath, dir) {
+				file.IncludePath = append(file.IncludePath, dir)
+			}
+		}
+	}
+}
+
+// Parses the file along with all the files it includes with the paths known
+// at parse time. The files that were already parsed are taken from the
+// `files` map, which also protects from the infinite include cycles. The
+// includes are looked up in `includePath` (usually the folders added by
+// $HOME/.markut) and the folders added by the file itself.
+func ParseMarkutTree(path string, includePath []string, files map[string]*File) (*File, error) {
+	if file, ok := files[path]; ok {
+		return file, nil
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	file := ParseMarkutContent(string(content), path)
+	files[path] = file
+	for _, dir := range file.IncludePath {
+		if !slices.Contains(includePath, dir) {
+			includePath = append(slices.Clip(includePath), dir)
+		}
+	}
+	for i := range file.Includes {
+		include := &file.Includes[i]
+		include.File, include.Err = ParseMarkutTree(resolveIncludePath(path, includePath, include.Path), includePath, files)
+	}
+	return file, nil
+}
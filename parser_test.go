@@ -0,0 +1,35 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestParseMarkutTree(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"MARKUT":       "\"lib\" include_path \"a.markut\" include \"b.markut\" include_if_exists",
+		"lib/a.markut": "\"MARKUT\" include",
+		"lib/MARKUT":   "1:00 2:00 chunk",
+	})
+	files := map[string]*File{}
+	file, err := ParseMarkutTree(filepath.Join(dir, "MARKUT"), nil, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(file.Includes) != 2 {
+		t.Fatalf("expected 2 includes but got %d", len(file.Includes))
+	}
+	a := file.Includes[0]
+	if a.Err != nil || a.File == nil || a.File.Path != filepath.Join(dir, "lib", "a.markut") {
+		t.Fatalf("expected a.markut to be found in the include path but got %+v", a)
+	}
+	if len(a.File.Includes) != 1 || a.File.Includes[0].File == nil || a.File.Includes[0].File.Path != filepath.Join(dir, "lib", "MARKUT") {
+		t.Errorf("expected a.markut to include the MARKUT next to it but got %+v", a.File.Includes)
+	}
+	if b := file.Includes[1]; b.Err == nil || !b.IfExists {
+		t.Errorf("expected b.markut to be missing but got %+v", b)
+	}
+	if len(files) != 3 {
+		t.Errorf("expected 3 parsed files but got %d", len(files))
+	}
+}
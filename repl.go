@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const ReplFilePath = "<repl>"
+
+func (context *EvalContext) PrintReplState() {
+	fmt.Printf("Stack (%d):", len(context.argsStack))
+	for _, arg := range context.argsStack {
+		fmt.Printf(" %s", displayValue(arg))
+	}
+	fmt.Printf("\n")
+	if len(context.chapStack) > 0 {
+		fmt.Printf("Pending chapters (%d):\n", len(context.chapStack))
+		for _, chapter := range context.chapStack {
+			fmt.Printf("    %s - %s\n", millisToTs(chapter.Timestamp), chapter.Label)
+		}
+	}
+	fmt.Printf("Chunks (%d):\n", len(context.chunks))
+	for index, chunk := range context.chunks {
+		fmt.Printf("    %2d - %s %s -> %s (Duration: %s)\n", index, chunk.InputPath, millisToTs(chunk.Start), millisToTs(chunk.End), millisToTs(chunk.Duration()))
+	}
+}
+
+func replHelp() {
+	fmt.Printf("Every line is evaluated as a piece of a MARKUT file. Blocks and lists may span several lines.\n")
+	fmt.Printf("COMMANDS:\n")
+	fmt.Printf("    :load <path>  Evaluate a MARKUT file in the current context\n")
+	fmt.Printf("    :reset        Start over with a fresh context\n")
+	fmt.Printf("    :finish       Run the final checks that are usually done after evaluating a MARKUT file\n")
+	fmt.Printf("    :summary      Print the summary of the video like `markut summary` does\n")
+	fmt.Printf("    :help         Print this help\n")
+	fmt.Printf("    :quit         Exit the REPL\n")
+}
+
+// Checks if the source has more brackets opened than closed, which means
+// that the user is still typing a block or a list
+func replBlockUnfinished(source string) bool {
+	lexer := NewLexer(source, ReplFilePath)
+	tokens, err := lexer.ChopAllTokens()
+	if err != nil {
+		return false
+	}
+	depth := 0
+	for _, token := range tokens {
+		switch token.Token.Kind {
+		case TokenCurlyOpen, TokenBracketOpen:
+			depth += 1
+		case TokenCurlyClose, TokenBracketClose:
+			depth -= 1
+		}
+	}
+	return depth > 0
+}
+
+func replSubcommand(name string, args []string) bool {
+	subFlag := flag.NewFlagSet(name, flag.ContinueOnError)
+	markutPtr := subFlag.String("markut", "", "Path to the MARKUT file to evaluate before starting the REPL")
+
+	err := parseSubcommandFlags(subFlag, args)
+	if err == flag.ErrHelp {
+		return true
+	}
+
+	if err != nil {
+		Diags.Error(Loc{}, "Could not parse command line arguments: %s", err)
+		return false
+	}
+
+	context, ok := defaultContext()
+	if !ok {
+		return false
+	}
+	if *markutPtr != "" {
+		context.evalMarkutFile(nil, *markutPtr, false)
+		context.PrintReplState()
+	}
+
+	fmt.Printf("Markut REPL. Type :help for help.\n")
+	scanner := bufio.NewScanner(os.Stdin)
+	row := 0
+	source := ""
+	sourceRow := 0
+	for {
+		Diags.Flush()
+		if source == "" {
+			fmt.Printf("> ")
+		} else {
+			fmt.Printf("... ")
+		}
+		if !scanner.Scan() {
+			fmt.Printf("\n")
+			break
+		}
+		line := scanner.Text()
+		row += 1
+
+		if source == "" {
+			command, arg, _ := strings.Cut(strings.TrimSpace(line), " ")
+			arg = strings.TrimSpace(arg)
+			switch command {
+			case ":quit", ":q":
+				return true
+			case ":help":
+				replHelp()
+				continue
+			case ":reset":
+				fresh, ok := defaultContext()
+				if !ok {
+					Diags.Error(Loc{}, "could not reset the context. Keeping the current one")
+					continue
+				}
+				context = fresh
+				context.PrintReplState()
+				continue
+			case ":load":
+				if arg == "" {
+					Diags.Error(Loc{}, ":load expects a path to a MARKUT file")
+					continue
+				}
+				context.evalMarkutFile(nil, arg, false)
+				context.PrintReplState()
+				continue
+			case ":finish":
+				if context.finishEval() {
+					fmt.Printf("OK\n")
+				}
+				continue
+			case ":summary":
+				if err := context.PrintSummary(); err != nil {
+					Diags.Error(Loc{}, "Could not print summary: %s", err)
+				}
+				continue
+			}
+			if strings.HasPrefix(command, ":") {
+				Diags.Error(Loc{}, "Unknown command %s. Type :help for help.", command)
+				continue
+			}
+			sourceRow = row - 1
+		}
+
+		source += line + "\n"
+		if replBlockUnfinished(source) {
+			continue
+		}
+
+		lexer := NewLexer(source, ReplFilePath)
+		lexer.Row = sourceRow
+		context.evalParsedFile(ParseLexer(&lexer))
+		source = ""
+		context.PrintReplState()
+	}
+	return scanner.Err() == nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Hooks into the evaluation of every node of the syntax tree. Used by the
+// `markut trace` subcommand for logging the evaluation and stopping at the
+// breakpoints.
+type Tracer struct {
+	// Breakpoint line. BreakFile may be empty, which means any file.
+	BreakFile string
+	BreakRow  int
+	HasBreak  bool
+
+	stepping bool
+	// Location of the previously evaluated node for each call depth
+	prevLocs []Loc
+	// How many lists are being evaluated right now. Their elements are
+	// logged with the extra indentation.
+	lists int
+	input *bufio.Scanner
+}
+
+func traceNodeString(node Node) string {
+	switch node.Kind {
+	case NodeBlock:
+		return displayNodes("{", node.Children, "}")
+	case NodeList:
+		return displayNodes("[", node.Children, "]")
+	default:
+		return fmtToken(node.Token)
+	}
+}
+
+func traceStackString(stack []Token) string {
+	sb := strings.Builder{}
+	fmt.Fprintf(&sb, "(%d)", len(stack))
+	for _, arg := range stack {
+		sb.WriteString(" ")
+		sb.WriteString(displayValue(arg))
+	}
+	return sb.String()
+}
+
+func (tracer *Tracer) isBreakpoint(depth int, loc Loc) bool {
+	if !tracer.HasBreak || loc.Row != tracer.BreakRow {
+		return false
+	}
+	if tracer.BreakFile != "" && loc.FilePath != tracer.BreakFile {
+		return false
+	}
+	// Only stop at the first node of the line we entered on the current call depth
+	if depth < len(tracer.prevLocs) {
+		prevLoc := tracer.prevLocs[depth]
+		return prevLoc.Row != loc.Row || prevLoc.FilePath != loc.FilePath
+	}
+	return true
+}
+
+// Returns false if the evaluation should be aborted
+func (tracer *Tracer) Before(context *EvalContext, node Node) bool {
+	loc := node.Token.Loc
+	indent := strings.Repeat("    ", context.callDepth+tracer.lists)
+	fmt.Printf("%s%s: %s\n", indent, loc, traceNodeString(node))
+	fmt.Printf("%s    before: %s\n", indent, traceStackString(context.argsStack))
+
+	depth := context.callDepth
+	if tracer.isBreakpoint(depth, loc) {
+		Diags.Note(loc, "stopped at the breakpoint")
+		tracer.stepping = true
+	}
+	tracer.prevLocs = append(tracer.prevLocs[:min(depth, len(tracer.prevLocs))], loc)
+	if node.Kind == NodeList {
+		tracer.lists += 1
+	}
+
+	for tracer.stepping {
+		Diags.Flush()
+		context.PrintReplState()
+		fmt.Printf("[s]tep, [c]ontinue, [q]uit> ")
+		if !tracer.input.Scan() {
+			fmt.Printf("\n")
+			tracer.stepping = false
+			break
+		}
+		switch strings.TrimSpace(tracer.input.Text()) {
+		case "", "s", "step":
+			return true
+		case "c", "continue":
+			tracer.stepping = false
+		case "q", "quit":
+			Diags.Note(loc, "the evaluation is aborted by the user")
+			context.aborted = true
+			return false
+		default:
+			Diags.Error(Loc{}, "unknown command")
+		}
+	}
+	return true
+}
+
+func (tracer *Tracer) After(context *EvalContext, node Node, ok bool) {
+	if node.Kind == NodeList {
+		tracer.lists -= 1
+	}
+	indent := strings.Repeat("    ", context.callDepth+tracer.lists)
+	if ok {
+		fmt.Printf("%s    after:  %s\n", indent, traceStackString(context.argsStack))
+	} else {
+		fmt.Printf("%s    FAILED: %s\n", indent, traceStackString(context.argsStack))
+	}
+}
+
+// Parses the breakpoint in the format LINE or FILE:LINE
+func parseBreakpoint(breakpoint string) (file string, row int, err error) {
+	index := strings.LastIndex(breakpoint, ":")
+	if index >= 0 {
+		file = breakpoint[:index]
+		breakpoint = breakpoint[index+1:]
+	}
+	line, err := strconv.Atoi(breakpoint)
+	if err != nil {
+		return
+	}
+	if line < 1 {
+		err = fmt.Errorf("line numbers start from 1")
+		return
+	}
+	row = line - 1
+	return
+}
+
+func traceSubcommand(name string, args []string) bool {
+	subFlag := flag.NewFlagSet(name, flag.ContinueOnError)
+	markutPtr := subFlag.String("markut", "MARKUT", "Path to the MARKUT file")
+	breakPtr := subFlag.String("break", "", "Stop at the specified line and evaluate step by step from there. Format: LINE or FILE:LINE. LINE alone refers to any file")
+
+	err := parseSubcommandFlags(subFlag, args)
+	if err == flag.ErrHelp {
+		return true
+	}
+
+	if err != nil {
+		Diags.Error(Loc{}, "Could not parse command line arguments: %s", err)
+		return false
+	}
+
+	tracer := &Tracer{
+		input: bufio.NewScanner(os.Stdin),
+	}
+	if *breakPtr != "" {
+		tracer.BreakFile, tracer.BreakRow, err = parseBreakpoint(*breakPtr)
+		if err != nil {
+			Diags.Error(Loc{}, "Invalid breakpoint %s: %s", *breakPtr, err)
+			return false
+		}
+		tracer.HasBreak = true
+	}
+
+	context, ok := defaultContext()
+	if !ok {
+		return false
+	}
+	context.tracer = tracer
+	ok = context.evalMarkutFile(nil, *markutPtr, false)
+	ok = context.finishEval() && ok
+	context.tracer = nil
+
+	fmt.Printf("\n>>> Final state:\n")
+	context.PrintReplState()
+	return ok
+}
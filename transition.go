@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+type TransitionKind int
+
+const (
+	TransitionCrossfade TransitionKind = iota
+	TransitionDipToBlack
+	// Hard cut for the video, crossfade for the audio
+	TransitionAudioCrossfade
+)
+
+var TransitionKindNames = map[TransitionKind]string{
+	TransitionCrossfade:      "crossfade",
+	TransitionDipToBlack:     "dip_to_black",
+	TransitionAudioCrossfade: "audio_crossfade",
+}
+
+// Transition between the chunk with the index After and the next one.
+// Introduced by the `transition` func.
+type Transition struct {
+	Loc      Loc
+	Kind     TransitionKind
+	Duration Millis
+	After    int
+}
+
+// The part of a rendered chunk that is a transition. From is the tail of the
+// chunk before the transition and To is the head of the chunk after it. Both
+// last exactly Duration in the final video, so with the changed speed they
+// cover a different duration of the input.
+type ChunkTransition struct {
+	Kind     TransitionKind
+	Duration Millis
+	From     Chunk
+	To       Chunk
+}
+
+func (transition ChunkTransition) Name() string {
+	// The names of the neighbour chunks without the folder and the extension
+	from := strings.TrimSuffix(strings.TrimPrefix(transition.From.Name(), ChunksFolder+"/"), ".mp4")
+	to := strings.TrimSuffix(strings.TrimPrefix(transition.To.Name(), ChunksFolder+"/"), ".mp4")
+	return fmt.Sprintf("%s/transition-%s-%s-%s.mp4", ChunksFolder, TransitionKindNames[transition.Kind], from, to)
+}
+
+func parseTransitionKind(name string) (TransitionKind, bool) {
+	for kind, kindName := range TransitionKindNames {
+		if kindName == name {
+			return kind, true
+		}
+	}
+	return 0, false
+}
+
+func (context EvalContext) transitionAfter(index int) *Transition {
+	for i := range context.transitions {
+		if context.transitions[i].After == index {
+			return &context.transitions[i]
+		}
+	}
+	return nil
+}
+
+// The chunks in the order they are rendered and concatenated into the final
+// video. The chunks joined by a transition are shortened by its duration and
+// the transition itself becomes a separate short chunk in between. That way
+// the main chunks are still rendered on their own, cached and concatenated
+// without reencoding.
+func (context EvalContext) renderChunks() []Chunk {
+	chunks := make([]Chunk, len(context.chunks))
+	copy(chunks, context.chunks)
+	result := []Chunk{}
+	for i := range chunks {
+		chunk := chunks[i]
+		transition := context.transitionAfter(i)
+		if transition == nil || i+1 >= len(chunks) {
+			if chunk.Duration() > 0 {
+				result = append(result, chunk)
+			}
+			continue
+		}
+		next := &chunks[i+1]
+		// The fades are for the hard cuts and make no sense around a
+		// transition
+		chunk.FadeOut = Fade{}
+		next.FadeIn = Fade{}
+		from := chunk
+		from.Start = chunk.End - chunk.scaleToInput(transition.Duration)
+		from.ExtraOutFlags = nil
+		from.FadeIn, from.FadeOut = Fade{}, Fade{}
+		to := *next
+		to.End = next.Start + next.scaleToInput(transition.Duration)
+		to.ExtraOutFlags = nil
+		to.FadeIn, to.FadeOut = Fade{}, Fade{}
+		chunk.End = from.Start
+		next.Start = to.End
+		if chunk.Duration() > 0 {
+			result = append(result, chunk)
+		}
+		result = append(result, Chunk{
+			Loc:        transition.Loc,
+			Start:      0,
+			End:        transition.Duration,
+			Unfinished: chunk.Unfinished || next.Unfinished,
+			Transition: &ChunkTransition{
+				Kind:     transition.Kind,
+				Duration: transition.Duration,
+				From:     from,
+				To:       to,
+			},
+		})
+	}
+	return result
+}
+
+// Makes sure the chunks around the transitions are long enough to be
+// shortened by them
+func (context *EvalContext) checkTransitions() bool {
+	ok := true
+	for i, chunk := range context.chunks {
+		// renderChunks() drops the fade on the side of the chunk joined by a
+		// transition. The fade on the other side must fit into what is left
+		// of the chunk.
+		incoming := context.transitionAfter(i - 1)
+		outgoing := context.transitionAfter(i)
+		var fade Fade
+		var name string
+		var transition *Transition
+		switch {
+		case incoming != nil && outgoing == nil:
+			fade, name, transition = chunk.FadeOut, "fade_out", incoming
+		case incoming == nil && outgoing != nil:
+			fade, name, transition = chunk.FadeIn, "fade_in", outgoing
+		default:
+			continue
+		}
+		shortened := chunk.OutputDuration() - transition.Duration
+		if fade.Duration > shortened {
+			Diags.Error(chunk.Loc, "the %s of %s is longer than the chunk shortened by the transition to %s", name, millisToTs(fade.Duration), millisToTs(max(shortened, 0))).
+				Note(transition.Loc, "the transition is defined here")
+			ok = false
+		}
+	}
+	for _, transition := range context.transitions {
+		if transition.After+1 >= len(context.chunks) {
+			Diags.Error(transition.Loc, "there is no chunk after the transition")
+			ok = false
+			continue
+		}
+		next := context.chunks[transition.After+1]
+		needed := transition.Duration
+		if outgoing := context.transitionAfter(transition.After + 1); outgoing != nil {
+			needed += outgoing.Duration
+		}
+		if next.OutputDuration() < needed {
+			Diags.Error(transition.Loc, "the chunk after the transition is %s long which is too short for the transitions of the total duration %s", millisToTs(next.OutputDuration()), millisToTs(needed)).
+				Note(next.Loc, "the chunk is defined here")
+			ok = false
+		}
+	}
+	return ok
+}
+
+// The input arguments and the -filter_complex that blends the tail of one
+// chunk with the head of the next one. The output streams are labeled [v]
+// and [a].
+func ffmpegTransitionArgs(context EvalContext, transition ChunkTransition) []string {
+	args := []string{}
+	for _, chunk := range []Chunk{transition.From, transition.To} {
+		args = append(args, "-ss", millisToSecsForFFmpeg(chunk.Start))
+		args = append(args, "-t", millisToSecsForFFmpeg(chunk.Duration()))
+		for _, inFlag := range context.ExtraInFlags {
+			args = append(args, string(inFlag.Text))
+		}
+		args = append(args, "-i", chunk.InputPath)
+	}
+
+	filters := []string{}
+	videos := []string{"[0:v]", "[1:v]"}
+	for i, chunk := range []Chunk{transition.From, transition.To} {
+		if filter := chunkVideoFilter(chunk, fmt.Sprintf("in%d", i)); filter != "" {
+			filters = append(filters, fmt.Sprintf("%s%s[v%d]", videos[i], filter, i))
+			videos[i] = fmt.Sprintf("[v%d]", i)
+		}
+	}
+	// The audio filters of the chunks, like the changed speed or the muted
+	// ranges, apply to the transition as well
+	audios := []string{"[0:a]", "[1:a]"}
+	for i, chunk := range []Chunk{transition.From, transition.To} {
+		if filter := chunkAudioFilter(chunk); filter != "" {
+			filters = append(filters, fmt.Sprintf("%s%s[a%d]", audios[i], filter, i))
+			audios[i] = fmt.Sprintf("[a%d]", i)
+		}
+	}
+	duration := millisToSecsForFFmpeg(transition.Duration)
+	switch transition.Kind {
+	case TransitionCrossfade:
+		filters = append(filters, fmt.Sprintf("%s%sxfade=transition=fade:duration=%s:offset=0[v]", videos[0], videos[1], duration))
+	case TransitionDipToBlack:
+		filters = append(filters, fmt.Sprintf("%s%sxfade=transition=fadeblack:duration=%s:offset=0[v]", videos[0], videos[1], duration))
+	case TransitionAudioCrossfade:
+		half := millisToSecsForFFmpeg(transition.Duration / 2)
+		filters = append(filters, fmt.Sprintf("%strim=end=%s,setpts=PTS-STARTPTS[vfrom]", videos[0], half))
+		filters = append(filters, fmt.Sprintf("%strim=start=%s,setpts=PTS-STARTPTS[vto]", videos[1], half))
+		filters = append(filters, "[vfrom][vto]concat=n=2:v=1:a=0[v]")
+	default:
+		panic("unreachable")
+	}
+	filters = append(filters, fmt.Sprintf("%s%sacrossfade=d=%s[a]", audios[0], audios[1], duration))
+
+	args = append(args, "-filter_complex", strings.Join(filters, ";"))
+	args = append(args, "-map", "[v]", "-map", "[a]")
+	return args
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestTransitionTiming(t *testing.T) {
+	cases := []struct {
+		content   string
+		durations []Millis
+		chapters  []Millis
+	}{
+		{
+			content:   "0:00 1:00 chunk",
+			durations: []Millis{60000},
+		},
+		{
+			content:   "0:00 1:00 chunk \"crossfade\" 0:01 transition 2:00 3:00 chunk",
+			durations: []Millis{59000, 1000, 59000},
+		},
+		{
+			content:   "0:00 1:00 chunk \"crossfade\" 0:01 transition 2:00 3:00 chunk \"dip_to_black\" 0:02 transition 4:00 5:00 chunk",
+			durations: []Millis{59000, 1000, 57000, 2000, 58000},
+		},
+		{
+			content:   "0:00 1:00 chunk \"audio_crossfade\" 0:01 transition removed 2:00 3:00 chunk",
+			durations: []Millis{60000},
+		},
+		{
+			content:   "0:00 1:00 chunk \"audio_crossfade\" 0:01 transition 2:00 3:00 chunk removed 4:00 5:00 chunk",
+			durations: []Millis{59000, 1000, 59000},
+		},
+		{
+			content:   "0:00 \"A\" chapter 0:00 1:00 chunk \"crossfade\" 0:04 transition 2:30 \"B\" chapter 2:00 3:00 chunk",
+			durations: []Millis{56000, 4000, 56000},
+			// B starts 30 seconds into the second chunk which overlaps with
+			// the first one by 4 seconds
+			chapters: []Millis{0, 86000},
+		},
+	}
+	for _, c := range cases {
+		context, ok := evalTestMarkut(c.content)
+		if !ok {
+			t.Errorf("%s: expected the evaluation to succeed", c.content)
+			continue
+		}
+		durations := []Millis{}
+		for _, chunk := range context.renderChunks() {
+			durations = append(durations, chunk.Duration())
+		}
+		if !slices.Equal(durations, c.durations) {
+			t.Errorf("%s: expected the rendered chunks of durations %v but got %v", c.content, c.durations, durations)
+		}
+		chapters := []Millis{}
+		for _, chapter := range context.chapters {
+			chapters = append(chapters, chapter.Timestamp)
+		}
+		if len(c.chapters) > 0 && !slices.Equal(chapters, c.chapters) {
+			t.Errorf("%s: expected the chapters at %v but got %v", c.content, c.chapters, chapters)
+		}
+	}
+}
+
+func TestTransitionErrors(t *testing.T) {
+	cases := []string{
+		"\"crossfade\" 0:01 transition 0:00 1:00 chunk",
+		"0:00 1:00 chunk \"wipe\" 0:01 transition 2:00 3:00 chunk",
+		"0:00 1:00 chunk \"crossfade\" 0:00 transition 2:00 3:00 chunk",
+		"0:00 1:00 chunk \"crossfade\" 0:01 transition \"crossfade\" 0:01 transition 2:00 3:00 chunk",
+		"0:00 0:01 chunk \"crossfade\" 0:02 transition 2:00 3:00 chunk",
+		"0:00 1:00 chunk \"crossfade\" 0:01 transition",
+		"0:00 1:00 chunk \"crossfade\" 0:02 transition 2:00 2:03 chunk \"crossfade\" 0:02 transition 4:00 5:00 chunk",
+	}
+	for _, content := range cases {
+		if _, ok := evalTestMarkut(content); ok {
+			t.Errorf("%s: expected the evaluation to fail", content)
+		}
+	}
+}
+
+func TestFadesAroundTransitions(t *testing.T) {
+	cases := []struct {
+		content string
+		// The audio filters of the rendered chunks, the transitions have none
+		filters []string
+	}{
+		{
+			content: "0:00 1:00 chunk 0:02 false fade_in 0:03 true fade_out",
+			filters: []string{"afade=t=in:st=0:d=2.000,afade=t=out:st=57.000:d=3.000"},
+		},
+		{
+			content: "0:00 1:00 chunk 0:02 false fade_in 0:02 false fade_out \"crossfade\" 0:01 transition 2:00 3:00 chunk 0:02 false fade_in 0:02 false fade_out",
+			filters: []string{"afade=t=in:st=0:d=2.000", "", "afade=t=out:st=57.000:d=2.000"},
+		},
+	}
+	for _, c := range cases {
+		context, ok := evalTestMarkut(c.content)
+		if !ok {
+			t.Errorf("%s: expected the evaluation to succeed", c.content)
+			continue
+		}
+		filters := []string{}
+		for _, chunk := range context.renderChunks() {
+			filters = append(filters, chunkAudioFilter(chunk))
+		}
+		if !slices.Equal(filters, c.filters) {
+			t.Errorf("%s: expected the audio filters %q but got %q", c.content, c.filters, filters)
+		}
+	}
+}
+
+func TestFadeErrors(t *testing.T) {
+	cases := []string{
+		"0:02 false fade_in 0:00 1:00 chunk",
+		"0:00 1:00 chunk 0:00 false fade_in",
+		"0:00 0:01 chunk 0:02 true fade_out",
+		// What is left of the chunk after the transition is too short for the
+		// fade on the other side
+		"0:00 0:05 chunk 0:04 false fade_in \"crossfade\" 0:02 transition 2:00 3:00 chunk",
+	}
+	for _, content := range cases {
+		if _, ok := evalTestMarkut(content); ok {
+			t.Errorf("%s: expected the evaluation to fail", content)
+		}
+	}
+}